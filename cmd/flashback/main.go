@@ -5,13 +5,15 @@ import (
 	"fmt"
 	"math"
 	"os"
+	"path/filepath"
 	"runtime"
+	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/closeio/flashback"
-	"gopkg.in/mgo.v2"
 )
 
 func panicOnError(err error) {
@@ -24,12 +26,14 @@ var (
 	maxOps                   int
 	numSkipOps               int
 	opsFilename              string
+	opsFormat                string
 	slowOpThresholdMs        int
 	socketTimeout            int64
 	startTime                int64
 	style                    string
 	cyclic                   bool
 	url                      string
+	backend                  string
 	challengerUrl            string
 	challengerUrl2           string
 	challengerUrl3           string
@@ -44,39 +48,174 @@ var (
 	challengerStatsFilename3 string
 	opFilter                 string
 	speedup                  float64
+	targetOpsPerSec          float64
+	loadProfileSpec          string
+	loadProfile              flashback.LoadProfile
+	maxLagMs                 int
+	lagPolicyName            string
+	lagPolicy                flashback.LagPolicy
+	commandPassthrough       bool
+	verifyResults            bool
+	dryRun                   bool
+	maxTimeMs                int
+	maxTimeMsByType          string
+	opTimeoutMs              int
+	timeouts                 flashback.Timeouts
+	retryMaxAttempts         int
+	retryBackoffMs           int
+	retryMaxBackoffMs        int
+	retryJitter              float64
+	retryErrors              string
+	retryPolicy              *flashback.BackoffRetryPolicy
+
+	// Authentication and TLS options of the default node and the challengers
+	defaultConnection     flashback.ConnectionOptions
+	challengerConnection  flashback.ConnectionOptions
+	challengerConnection2 flashback.ConnectionOptions
+	challengerConnection3 flashback.ConnectionOptions
+
+	// Write concern, read preference and read concern of each node
+	defaultConsistency     flashback.Consistency
+	challengerConsistency  flashback.Consistency
+	challengerConsistency2 flashback.Consistency
+	challengerConsistency3 flashback.Consistency
+
+	// Groups the ops of each transaction, and tells how many transactions
+	// never ended
+	transactions *flashback.TransactionOpsReader
 )
 
 const (
 	// Set one minute timeout on mongo socket connections (nanoseconds) by default
-	defaultMgoSocketTimeout = 60000000000
+	defaultSocketTimeout = 60000000000
 )
 
+// Register the authentication and TLS flags of a node, e.g. --username for
+// the default node and --challenger_username2 for challenger2.
+func connectionFlags(opts *flashback.ConnectionOptions, prefix string, suffix string, nodeName string) {
+	name := func(option string) string {
+		return prefix + option + suffix
+	}
+	flag.StringVar(&opts.Username,
+		name("username"),
+		"",
+		"[Optional] Username to authenticate with on the "+nodeName+" node.")
+	flag.StringVar(&opts.Password,
+		name("password"),
+		"",
+		"[Optional] Password to authenticate with on the "+nodeName+" node.")
+	flag.StringVar(&opts.AuthSource,
+		name("auth_source"),
+		"",
+		"[Optional] Database to authenticate against on the "+nodeName+" node. "+
+			"Defaults to admin, or $external for x.509.")
+	flag.StringVar(&opts.AuthMechanism,
+		name("auth_mechanism"),
+		"",
+		"[Optional] Authentication mechanism for the "+nodeName+" node: SCRAM-SHA-1, SCRAM-SHA-256 "+
+			"or MONGODB-X509. Negotiated with the server by default.")
+	flag.BoolVar(&opts.TLS,
+		name("tls"),
+		false,
+		"[Optional] Connect to the "+nodeName+" node with TLS.")
+	flag.StringVar(&opts.TLSCAFile,
+		name("tls_ca_file"),
+		"",
+		"[Optional] PEM file with the certificate authorities to trust for the "+nodeName+" node. "+
+			"Implies --"+name("tls")+".")
+	flag.StringVar(&opts.TLSCertificateKeyFile,
+		name("tls_certificate_key_file"),
+		"",
+		"[Optional] PEM file with the client certificate and key to present to the "+nodeName+" node, "+
+			"e.g. for x.509 authentication. Implies --"+name("tls")+".")
+}
+
+// Register the write concern, read preference and read concern flags of a
+// node, named the same way as its connection flags.
+func consistencyFlags(c *flashback.Consistency, prefix string, suffix string, nodeName string) {
+	name := func(option string) string {
+		return prefix + option + suffix
+	}
+	flag.StringVar(&c.W,
+		name("write_concern"),
+		"",
+		"[Optional] Write concern of the writes sent to the "+nodeName+" node: a number of nodes, "+
+			"\"majority\" or a custom mode. Left to the server by default.")
+	flag.BoolVar(&c.J,
+		name("journal"),
+		false,
+		"[Optional] Wait for the writes sent to the "+nodeName+" node to be journaled.")
+	flag.IntVar(&c.WTimeoutMs,
+		name("wtimeout_ms"),
+		0,
+		"[Optional] Write concern timeout of the writes sent to the "+nodeName+" node.")
+	flag.BoolVar(&c.ReplayWriteConcern,
+		name("replay_write_concern"),
+		false,
+		"[Optional] Replay the write concern recorded with each write against the "+nodeName+" node, "+
+			"when there is one, instead of --"+name("write_concern")+".")
+	flag.StringVar(&c.ReadPreference,
+		name("read_preference"),
+		"",
+		"[Optional] Read preference of the reads sent to the "+nodeName+" node: primary, primaryPreferred, "+
+			"secondary, secondaryPreferred or nearest. By default queries use the read preference they "+
+			"were recorded with, and other reads go to the primary.")
+	flag.StringVar(&c.ReadPreferenceTags,
+		name("read_preference_tags"),
+		"",
+		"[Optional] Read preference tag sets for the "+nodeName+" node, tried in order, "+
+			"e.g. \"dc:east,rack:1;dc:west\".")
+	flag.StringVar(&c.ReadConcern,
+		name("read_concern"),
+		"",
+		"[Optional] Read concern level of the reads sent to the "+nodeName+" node, e.g. local or majority. "+
+			"Left to the server by default.")
+}
+
 func init() {
 	flag.StringVar(&opsFilename,
 		"ops_filename",
 		"",
 		"The file for the serialized ops, generated by the Record scripts.")
+	flag.StringVar(&opsFormat,
+		"ops_format",
+		"",
+		"[Optional] Format of the ops file. You can choose: \n"+
+			"	json: one extended JSON op per line\n"+
+			"	bson: a stream of BSON op documents\n"+
+			"By default, files ending in .bson are read as bson and everything else as json. "+
+			"Files compressed with gzip or zstd are decompressed on the fly")
 	flag.StringVar(&url,
 		"url",
 		"",
-		"[Optional] The database server's url, in the format of <host>[:<port>]. Defaults to localhost:27017")
+		"[Optional] The database server's url, either in the format of <host>[:<port>] or as a "+
+			"mongodb:// connection string. Defaults to localhost:27017")
+	flag.StringVar(&backend,
+		"backend",
+		"",
+		"[Optional] Backend that replays the ops against the nodes, among: "+
+			strings.Join(flashback.Backends(), ", ")+". Picked from the scheme of each node's url by default, "+
+			"urls without a scheme being mongodb ones.")
 	flag.StringVar(&challengerUrl,
 		"challenger_url",
 		"",
 		"[Optional] Url of the challenger, another mongo database configured with different parameters. "+
-			"Queries will be sent into both simultaneously Format: <host>[:<port>]. Not used by default. "+
+			"Queries will be sent into both simultaneously Format: <host>[:<port>] "+
+			"or a mongodb:// connection string. Not used by default. "+
 			"Supported by only \"real\" style")
 	flag.StringVar(&challengerUrl2,
 		"challenger_url2",
 		"",
 		"[Optional] Url of the challenger2, another mongo database configured with different parameters. "+
-			"Queries will be sent into both simultaneously Format: <host>[:<port>]. Not used by default. "+
+			"Queries will be sent into both simultaneously Format: <host>[:<port>] "+
+			"or a mongodb:// connection string. Not used by default. "+
 			"Supported by only \"real\" style")
 	flag.StringVar(&challengerUrl3,
 		"challenger_url3",
 		"",
 		"[Optional] Url of the challenger3, another mongo database configured with different parameters. "+
-			"Queries will be sent into both simultaneously Format: <host>[:<port>]. Not used by default. "+
+			"Queries will be sent into both simultaneously Format: <host>[:<port>] "+
+			"or a mongodb:// connection string. Not used by default. "+
 			"Supported by only \"real\" style")
 	flag.StringVar(&style,
 		"style",
@@ -89,6 +228,36 @@ func init() {
 		1.0,
 		"This option is for \"real\" style. Instead of replaying ops realtime, you can use this option "+
 			"to speedup or slowdown execution. For example, setting speedup to 2 will send ops 2x faster")
+	flag.IntVar(&maxLagMs,
+		"max_lag_ms",
+		0,
+		"[Optional] This option is for \"real\" style. How far, in milliseconds, the replay may fall behind "+
+			"the recording (divided by speedup) before `lag_policy` applies. 0 means no limit.")
+	flag.StringVar(&lagPolicyName,
+		"lag_policy",
+		string(flashback.ContinueOnLag),
+		"This option is for \"real\" style, with `max_lag_ms`. What to do with the ops that are late by "+
+			"more than `max_lag_ms`. You can choose: \n"+
+			"	continue: send them anyway, the replay runs behind the recording\n"+
+			"	drop: drop them, until the replay catches up with the recording\n"+
+			"	abort: stop replaying")
+	flag.Float64Var(&targetOpsPerSec,
+		"target_ops_per_sec",
+		0,
+		"[Optional] This option is for \"stress\" style. Instead of replaying ops as fast as the workers "+
+			"execute them, send them at this fixed rate, whatever their timestamps, to measure latencies under "+
+			"a given load. The report tells when the ops can't be sent as fast.")
+	flag.StringVar(&loadProfileSpec,
+		"load_profile",
+		"",
+		"[Optional] This option is for \"stress\" style. Send ops at a rate that changes over time, "+
+			"whatever their timestamps. You can choose: \n"+
+			"	ramp:from=<ops/sec>,to=<ops/sec>,over=<duration>: grow the rate linearly, then keep it\n"+
+			"	steps:from=<ops/sec>,step=<ops/sec>,every=<duration>[,max=<ops/sec>]: grow the rate by steps\n"+
+			"	sine:mean=<ops/sec>,amplitude=<ops/sec>,period=<duration>: make the rate oscillate\n"+
+			"	csv:<file>: interpolate between the \"seconds,ops_per_sec\" lines of a file, and stop after "+
+			"the last one\n"+
+			"Durations are written like 30s or 5m. The stats of each interval are tagged with the target rate.")
 	flag.BoolVar(&cyclic,
 		"cyclic",
 		false,
@@ -110,7 +279,7 @@ func init() {
 			" exceeds available memory and you're running in stress mode.")
 	flag.Int64Var(&socketTimeout,
 		"socketTimeout",
-		defaultMgoSocketTimeout,
+		defaultSocketTimeout,
 		"[Optional] Mongo socket timeout in nanoseconds.")
 	flag.IntVar(&slowOpThresholdMs,
 		"slow_op_threshold_ms",
@@ -153,6 +322,65 @@ func init() {
 		"op_filter",
 		"",
 		"[Optional] If specified, we'll only execute ops of that particular type")
+	flag.BoolVar(&commandPassthrough,
+		"command_passthrough",
+		false,
+		"[Optional] Send commands that can't be replayed natively to the server exactly as they were recorded, "+
+			"and report them as the \"command\" op type. By default such commands are skipped.")
+	flag.BoolVar(&verifyResults,
+		"verify_results",
+		false,
+		"[Optional] Compare the results of the ops replayed against each challenger with the results of the "+
+			"same ops against the default node, log the mismatches and summarize them at the end.")
+	flag.BoolVar(&dryRun,
+		"dry_run",
+		false,
+		"[Optional] Read, canonicalize and dispatch the ops without connecting to any node, and report how "+
+			"many ops of each type would be executed, skipped or rejected, and why. The style is ignored.")
+	flag.IntVar(&maxTimeMs,
+		"max_time_ms",
+		0,
+		"[Optional] maxTimeMS to send with every op that supports it, instead of the one it was recorded with.")
+	flag.StringVar(&maxTimeMsByType,
+		"max_time_ms_by_type",
+		"",
+		"[Optional] maxTimeMS by op type, taking precedence over max_time_ms, "+
+			"e.g. \"query:1000,command.aggregate:5000\".")
+	flag.IntVar(&opTimeoutMs,
+		"op_timeout_ms",
+		0,
+		"[Optional] Client side deadline of each op, retries included. Turned off by default.")
+	flag.IntVar(&retryMaxAttempts,
+		"retry_max_attempts",
+		2,
+		"[Optional] Attempts of each op in total, retries included. 1 turns off retries.")
+	flag.IntVar(&retryBackoffMs,
+		"retry_backoff_ms",
+		0,
+		"[Optional] Delay before the first retry of an op, doubled for each further retry.")
+	flag.IntVar(&retryMaxBackoffMs,
+		"retry_max_backoff_ms",
+		10000,
+		"[Optional] Maximal delay between two attempts of an op.")
+	flag.Float64Var(&retryJitter,
+		"retry_jitter",
+		0.5,
+		"[Optional] Fraction of the retry delays, between 0 and 1, that is randomized.")
+	flag.StringVar(&retryErrors,
+		"retry_errors",
+		string(flashback.NetworkError),
+		"[Optional] Comma separated categories of the errors to retry, among: duplicate_key, timeout, network, "+
+			"write_conflict, not_primary, server and client.")
+
+	connectionFlags(&defaultConnection, "", "", "default")
+	connectionFlags(&challengerConnection, "challenger_", "", "challenger")
+	connectionFlags(&challengerConnection2, "challenger_", "2", "challenger2")
+	connectionFlags(&challengerConnection3, "challenger_", "3", "challenger3")
+
+	consistencyFlags(&defaultConsistency, "", "", "default")
+	consistencyFlags(&challengerConsistency, "challenger_", "", "challenger")
+	consistencyFlags(&challengerConsistency2, "challenger_", "2", "challenger2")
+	consistencyFlags(&challengerConsistency3, "challenger_", "3", "challenger3")
 }
 
 func parseFlags() error {
@@ -160,18 +388,74 @@ func parseFlags() error {
 	validArgs := true
 	errorMsg := ""
 
-	if style == "" {
+	if style == "" && !dryRun {
 		validArgs = false
 		errorMsg = "Missing `style` argument."
-	} else if style != "stress" && style != "real" {
+	} else if style != "" && style != "stress" && style != "real" {
 		validArgs = false
 		errorMsg = "Invalid `style` argument passed to program: " + style + ". The only acceptable values are \"stress\" and \"real\"."
 	} else if opsFilename == "" {
 		validArgs = false
 		errorMsg = "Missing required `ops_filename` argument."
+	} else if opsFormat != "" && opsFormat != "json" && opsFormat != "bson" {
+		validArgs = false
+		errorMsg = "Invalid `ops_format` argument passed to program: " + opsFormat + ". The only acceptable values are \"json\" and \"bson\"."
+	} else if targetOpsPerSec < 0 || (targetOpsPerSec > 0 && style != "stress" && !dryRun) {
+		validArgs = false
+		errorMsg = "The `target_ops_per_sec` argument must be a positive number, for \"stress\" style only."
+	} else if loadProfileSpec != "" && ((style != "stress" && !dryRun) || targetOpsPerSec > 0) {
+		validArgs = false
+		errorMsg = "The `load_profile` argument is for \"stress\" style only, and can't be used with `target_ops_per_sec`."
+	} else if maxLagMs < 0 || (maxLagMs > 0 && style != "real" && !dryRun) {
+		validArgs = false
+		errorMsg = "The `max_lag_ms` argument can't be negative, and is for \"real\" style only."
+	} else if policy, err := flashback.ParseLagPolicy(lagPolicyName); err != nil {
+		validArgs = false
+		errorMsg = "Invalid `lag_policy` argument: " + err.Error()
 	} else if workers <= 0 {
 		validArgs = false
 		errorMsg = "The `workers` argument must be a positive number."
+	} else if maxTimeMs < 0 || opTimeoutMs < 0 {
+		validArgs = false
+		errorMsg = "The `max_time_ms` and `op_timeout_ms` arguments can't be negative."
+	} else if retryMaxAttempts < 1 || retryBackoffMs < 0 || retryMaxBackoffMs < 0 {
+		validArgs = false
+		errorMsg = "The `retry_max_attempts` argument must be a positive number, and the retry backoffs can't be negative."
+	} else if retryJitter < 0 || retryJitter > 1 {
+		validArgs = false
+		errorMsg = "The `retry_jitter` argument must be between 0 and 1."
+	} else if byType, err := flashback.ParseMaxTimeMsByType(maxTimeMsByType); err != nil {
+		validArgs = false
+		errorMsg = "Invalid `max_time_ms_by_type` argument: " + err.Error()
+	} else {
+		lagPolicy = policy
+		timeouts = flashback.Timeouts{
+			MaxTimeMs:       maxTimeMs,
+			MaxTimeMsByType: byType,
+			Deadline:        time.Duration(opTimeoutMs) * time.Millisecond,
+		}
+	}
+	if validArgs && loadProfileSpec != "" {
+		if profile, err := flashback.ParseLoadProfile(loadProfileSpec); err != nil {
+			validArgs = false
+			errorMsg = "Invalid `load_profile` argument: " + err.Error()
+		} else {
+			loadProfile = profile
+		}
+	}
+	if validArgs {
+		if categories, err := flashback.ParseErrorCategories(retryErrors); err != nil {
+			validArgs = false
+			errorMsg = "Invalid `retry_errors` argument: " + err.Error()
+		} else {
+			retryPolicy = &flashback.BackoffRetryPolicy{
+				MaxAttempts:     retryMaxAttempts,
+				InitialBackoff:  time.Duration(retryBackoffMs) * time.Millisecond,
+				MaxBackoff:      time.Duration(retryMaxBackoffMs) * time.Millisecond,
+				Jitter:          retryJitter,
+				RetryableErrors: categories,
+			}
+		}
 	}
 
 	if !validArgs {
@@ -188,8 +472,51 @@ func parseFlags() error {
 	return nil
 }
 
-// Prepare an ops channel which will feed new ops to each worker
-func makeOpsChan(style string, opsFilename string, logger *flashback.Logger) (chan *flashback.Op, error) {
+// Get the format of the ops file, json or bson
+func opsFileFormat(opsFilename string) string {
+	if opsFormat != "" {
+		return opsFormat
+	}
+	// Compression is detected by the reader itself, so look past the
+	// compression suffix, e.g. "ops.bson.gz"
+	name := opsFilename
+	switch filepath.Ext(name) {
+	case ".gz", ".zst", ".zstd":
+		name = strings.TrimSuffix(name, filepath.Ext(name))
+	}
+	if filepath.Ext(name) == ".bson" {
+		return "bson"
+	}
+	return "json"
+}
+
+// Open the ops file with the reader matching its format. The records that are
+// skipped or rejected are passed to issueHandler, if any.
+func newOpsReader(opsFilename string, logger *flashback.Logger,
+	issueHandler func(flashback.OpIssue)) (flashback.OpsReader, error) {
+	if opsFileFormat(opsFilename) == "bson" {
+		err, reader := flashback.NewFileBSONOpsReader(opsFilename, logger, opFilter)
+		if err != nil {
+			return nil, err
+		}
+		if issueHandler != nil {
+			reader.ReportIssues(issueHandler)
+		}
+		return reader, nil
+	}
+	err, reader := flashback.NewFileByLineOpsReader(opsFilename, logger, opFilter)
+	if err != nil {
+		return nil, err
+	}
+	if issueHandler != nil {
+		reader.ReportIssues(issueHandler)
+	}
+	return reader, nil
+}
+
+// Prepare the reader of the ops to replay
+func makeOpsReader(style string, opsFilename string, logger *flashback.Logger,
+	issueHandler func(flashback.OpIssue)) (flashback.OpsReader, error) {
 	var (
 		reader flashback.OpsReader
 		err    error
@@ -198,12 +525,12 @@ func makeOpsChan(style string, opsFilename string, logger *flashback.Logger) (ch
 	// Set up the correct reader
 	if style == "real" && cyclic == true {
 		reader = flashback.NewCyclicOpsReader(func() flashback.OpsReader {
-			err, reader := flashback.NewFileByLineOpsReader(opsFilename, logger, opFilter)
+			reader, err := newOpsReader(opsFilename, logger, issueHandler)
 			panicOnError(err)
 			return reader
 		}, logger)
 	} else {
-		err, reader = flashback.NewFileByLineOpsReader(opsFilename, logger, opFilter)
+		reader, err = newOpsReader(opsFilename, logger, issueHandler)
 		if err != nil {
 			return nil, err
 		}
@@ -222,12 +549,142 @@ func makeOpsChan(style string, opsFilename string, logger *flashback.Logger) (ch
 		}
 	}
 
-	// Return the correct dispatcher
-	if style == "stress" {
-		return flashback.NewBestEffortOpsDispatcher(reader, maxOps, logger), nil
+	// Replay the ops of each transaction together
+	transactions = flashback.NewTransactionOpsReader(reader, logger)
+	return transactions, nil
+}
+
+// Tell whether the ops are sent at a target rate, fixed or by load profile,
+// rather than as fast as possible or by time
+func followsTargetRate() bool {
+	return targetOpsPerSec > 0 || loadProfile != nil
+}
+
+// Prepare an ops channel which will feed new ops to each worker. Dispatchers
+// that follow a schedule record how well they keep up with it in stats.
+func makeOpsChan(style string, reader flashback.OpsReader, logger *flashback.Logger,
+	stats *flashback.DispatchStats) chan *flashback.Op {
+	if style == "stress" && targetOpsPerSec > 0 {
+		return flashback.NewTargetRateOpsDispatcher(reader, maxOps, logger, targetOpsPerSec, stats)
+	} else if style == "stress" && loadProfile != nil {
+		return flashback.NewLoadProfileOpsDispatcher(reader, maxOps, logger, loadProfile, stats)
+	} else if style == "stress" {
+		return flashback.NewBestEffortOpsDispatcher(reader, maxOps, logger)
+	} else {
+		return flashback.NewByTimeOpsDispatcher(reader, maxOps, logger, speedup, stats,
+			time.Duration(maxLagMs)*time.Millisecond, lagPolicy)
+	}
+}
+
+// Canonicalize an op the way it is replayed. Commands that can't be replayed
+// natively are passed through if asked to, and skipped otherwise: the names of
+// the commands are returned in both cases, with a nil op if it is skipped.
+// Transactions are passed through or skipped as a whole, and their commands
+// are named "<command> in transaction".
+func canonicalizeOp(op *flashback.Op) (*flashback.Op, []string) {
+	if canonicalOp := flashback.CanonicalizeOp(op); canonicalOp != nil {
+		return canonicalOp, nil
+	}
+	commandName := func(op *flashback.Op) string {
+		if name := flashback.CommandName(op); name != "" {
+			return name
+		}
+		return "unknown"
+	}
+
+	var names []string
+	passthrough := commandPassthrough
+	if op.Type == flashback.Transaction {
+		for _, txnOp := range op.Ops {
+			if txnOp.Type == flashback.Command {
+				name := commandName(txnOp)
+				passthrough = passthrough && name != "unknown"
+				names = append(names, name+" in transaction")
+			}
+		}
 	} else {
-		return flashback.NewByTimeOpsDispatcher(reader, maxOps, logger, speedup), nil
+		name := commandName(op)
+		passthrough = passthrough && name != "unknown"
+		names = append(names, name)
 	}
+	if !passthrough {
+		return nil, names
+	}
+	return op, names
+}
+
+// Check the ops file without connecting to any node: the ops go through the
+// same reader and canonicalization as in a replay, but are executed by a
+// DryRunExecutor. Returns the number of rejected records.
+func runDryRun() int64 {
+	exec := flashback.NewDryRunExecutor()
+	reader, err := makeOpsReader("stress", opsFilename, logger, exec.Report)
+	panicOnError(err)
+	defer reader.Close()
+
+	// The ops are read as they are checked, rather than loaded up front by a
+	// dispatcher, so that files of any size can be checked
+	for i := 0; i < maxOps; i++ {
+		op := reader.Next()
+		if op == nil {
+			break
+		}
+		canonicalOp, commands := canonicalizeOp(op)
+		if canonicalOp == nil {
+			exec.Report(flashback.OpIssue{Position: op.Position, OpType: op.Type,
+				Reason: "command not replayed natively: " + strings.Join(commands, ", ")})
+			continue
+		}
+		exec.Execute(canonicalOp)
+	}
+
+	position := "line"
+	if opsFileFormat(opsFilename) == "bson" {
+		position = "document"
+	}
+	executed := exec.Executed()
+	issues := exec.Issues()
+	var totalExecuted, totalSkipped, totalRejected int64
+	for _, count := range executed {
+		totalExecuted += count
+	}
+	for _, issue := range issues {
+		if issue.Rejected {
+			totalRejected += issue.Count
+		} else {
+			totalSkipped += issue.Count
+		}
+	}
+	logger.Infof("Dry run of %s: %d ops would be executed, %d skipped, %d rejected", opsFilename,
+		totalExecuted, totalSkipped, totalRejected)
+	for _, opType := range flashback.AllOpTypes {
+		if executed[opType] > 0 {
+			logger.Infof("  Op type: %s, would be executed: %d", opType, executed[opType])
+		}
+	}
+	for _, issue := range issues {
+		outcome := "skipped"
+		if issue.Rejected {
+			outcome = "rejected"
+		}
+		opType := string(issue.OpType)
+		if opType == "" {
+			opType = "unknown"
+		}
+		positions := make([]string, len(issue.Positions))
+		for i, p := range issue.Positions {
+			positions[i] = fmt.Sprint(p)
+		}
+		if int64(len(positions)) < issue.Count {
+			positions = append(positions, "...")
+		}
+		logger.Infof("  Op type: %s, %s: %d, %s (%s %s)", opType, outcome, issue.Count, issue.Reason,
+			position, strings.Join(positions, ", "))
+	}
+	if neverEnded := transactions.NeverEnded(); neverEnded > 0 {
+		logger.Warningf("%d transactions never ended in the ops file, they would be committed", neverEnded)
+	}
+	return totalRejected
 }
 
 // Each node represents a separate MongoDB instance that you want to test.
@@ -236,17 +693,30 @@ func makeOpsChan(style string, opsFilename string, logger *flashback.Logger) (ch
 type node struct {
 	name          string
 	url           string
+	backend       flashback.Backend
 	statsFile     *os.File
 	statsChan     chan flashback.OpStat
 	statsAnalyzer *flashback.StatsAnalyzer
+
+	// Compares the results of a challenger with the ones of the default node
+	verifier *flashback.ResultVerifier
 }
 
 // Each worker has a separate nodeWorkerState for each node. This struct
-// contains information about the MongoDB connection for a given worker/node.
+// contains the executor a given worker uses for a given node, and the error
+// of the last op.
 type nodeWorkerState struct {
 	name    string
-	session *mgo.Session
-	exec    *flashback.OpsExecutor
+	exec    flashback.Executor
+	lastErr error
+}
+
+// Get the result of the last op of an executor, or nil if it doesn't keep it
+func lastResult(exec flashback.Executor) interface{} {
+	if e, ok := exec.(flashback.ResultExecutor); ok {
+		return e.LastResult()
+	}
+	return nil
 }
 
 func main() {
@@ -254,12 +724,24 @@ func main() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
 	err := parseFlags()
 	panicOnError(err)
+
+	if dryRun {
+		rejected := runDryRun()
+		logger.Close()
+		if rejected > 0 {
+			os.Exit(1)
+		}
+		return
+	}
 	defer logger.Close()
 
-	opsChan, err := makeOpsChan(style, opsFilename, logger)
+	reader, err := makeOpsReader(style, opsFilename, logger, nil)
 	panicOnError(err)
+	dispatchStats := flashback.NewDispatchStats()
+	opsChan := makeOpsChan(style, reader, logger, dispatchStats)
 
-	createNode := func(name string, nodeUrl string, filename string) node {
+	createNode := func(name string, nodeUrl string, connection *flashback.ConnectionOptions,
+		consistency *flashback.Consistency, filename string) node {
 		var n node
 
 		// stats file
@@ -273,34 +755,68 @@ func main() {
 
 		n.name = name
 		n.url = nodeUrl
+		if err := consistency.Validate(); err != nil {
+			panic(fmt.Sprintf("invalid options for the %s node: %v", name, err))
+		}
 		n.statsChan = make(chan flashback.OpStat, workers*100)
 		n.statsAnalyzer = flashback.NewStatsAnalyzer(n.statsChan)
+		if followsTargetRate() {
+			n.statsAnalyzer.SetTargetRate(dispatchStats.TargetRate)
+		}
+		// The connection is shared by all the workers, so its pool gets a
+		// connection per worker unless the connection string says otherwise
+		connection.Url = nodeUrl
+		connection.PoolSize = workers
+		connection.SocketTimeout = time.Duration(socketTimeout)
+		var err error
+		n.backend, err = flashback.OpenBackend(backend, &flashback.BackendOptions{
+			Connection:  *connection,
+			Consistency: consistency,
+			Timeouts:    &timeouts,
+			RetryPolicy: retryPolicy,
+			StatsChan:   n.statsChan,
+			Logger:      logger,
+		})
+		if err != nil {
+			panic(fmt.Sprintf("could not connect to the %s node: %v", name, err))
+		}
+		if verifyResults && name != "default" {
+			n.verifier = flashback.NewResultVerifier(name, logger)
+		}
 		return n
 	}
 
 	var nodes []node
 
 	// create the "default" node
-	nodes = append(nodes, createNode("default", url, statsFilename))
+	nodes = append(nodes, createNode("default", url, &defaultConnection, &defaultConsistency, statsFilename))
 
 	// create the "challenger" nodes if they were specified
 	if challengerUrl != "" {
-		nodes = append(nodes, createNode("challenger", challengerUrl, challengerStatsFilename))
+		nodes = append(nodes, createNode("challenger", challengerUrl, &challengerConnection, &challengerConsistency,
+			challengerStatsFilename))
 	}
 	if challengerUrl2 != "" {
-		nodes = append(nodes, createNode("challenger2", challengerUrl2, challengerStatsFilename2))
+		nodes = append(nodes, createNode("challenger2", challengerUrl2, &challengerConnection2, &challengerConsistency2,
+			challengerStatsFilename2))
 	}
 	if challengerUrl3 != "" {
-		nodes = append(nodes, createNode("challenger3", challengerUrl3, challengerStatsFilename3))
+		nodes = append(nodes, createNode("challenger3", challengerUrl3, &challengerConnection3, &challengerConsistency3,
+			challengerStatsFilename3))
 	}
 
-	// Close stats files
+	// Close stats files and connections
 	for _, n := range nodes {
 		if n.statsFile != nil {
 			defer n.statsFile.Close()
 		}
+		defer n.backend.Close()
 	}
 
+	// Keep track of the commands that were skipped or passed through, by name
+	skippedOps := flashback.NewOpCounter()
+	passthroughOps := flashback.NewOpCounter()
+
 	// Set up workers to do the job
 	exit := make(chan int)
 	opsExecuted := int64(0)
@@ -309,17 +825,11 @@ func main() {
 
 		workerStates := make([]nodeWorkerState, len(nodes))
 
-		// Connect to MongoDB for each node
+		// Set up an executor for each node
 		for i, n := range nodes {
-			session, err := mgo.Dial(n.url)
+			exec, err := n.backend.NewExecutor()
 			panicOnError(err)
-			session.SetSocketTimeout(time.Duration(socketTimeout))
-			defer session.Close()
-			workerStates[i] = nodeWorkerState{
-				n.name,
-				session,
-				flashback.NewOpsExecutor(session, n.statsChan, logger),
-			}
+			workerStates[i] = nodeWorkerState{n.name, exec, nil}
 		}
 
 		for {
@@ -329,32 +839,51 @@ func main() {
 			if op == nil {
 				break
 			}
-			op = flashback.CanonicalizeOp(op)
-			if op == nil {
+			canonicalOp, commands := canonicalizeOp(op)
+			for _, command := range commands {
+				if canonicalOp == nil {
+					skippedOps.Add(command)
+				} else {
+					passthroughOps.Add(command)
+				}
+			}
+			if canonicalOp == nil {
 				continue
 			}
+			op = canonicalOp
 
 			var wg sync.WaitGroup
 			wg.Add(len(nodes))
 
-			execute := func(executor *flashback.OpsExecutor, name string) {
+			execute := func(ws *nodeWorkerState) {
 				defer wg.Done()
-				err := executor.Execute(op)
+				err := ws.exec.Execute(op)
+				ws.lastErr = err
 				if err != nil {
 					if verbose == true {
 						logger.Error(fmt.Sprintf(
-							"[%s] error executing op - type:%s,database:%s,collection:%s,error:%s", name,
+							"[%s] error executing op - type:%s,database:%s,collection:%s,error:%s", ws.name,
 							op.Type, op.Database, op.Collection, err))
 					}
 				}
 			}
 
 			// Execute the operation for each node
-			for _, ws := range workerStates {
-				go execute(ws.exec, ws.name)
+			for i := range workerStates {
+				go execute(&workerStates[i])
 			}
 			wg.Wait()
 
+			// Compare the results of the challengers with the ones of the
+			// default node
+			if verifyResults {
+				expected := workerStates[0]
+				for i, ws := range workerStates[1:] {
+					nodes[i+1].verifier.Verify(op, lastResult(expected.exec), expected.lastErr,
+						lastResult(ws.exec), ws.lastErr)
+				}
+			}
+
 			// If slow operations' threshold has been set, determine if any of
 			// the ops were slow and print some information about them
 			if slowOpThresholdMs > 0 {
@@ -381,6 +910,9 @@ func main() {
 			// Increase the counter of executed operations
 			atomic.AddInt64(&opsExecuted, 1)
 		}
+		for _, ws := range workerStates {
+			ws.exec.Close()
+		}
 		exit <- 1
 		logger.Infof("Worker #%d done!\n", id)
 	}
@@ -390,12 +922,41 @@ func main() {
 		go fetch(i)
 	}
 
+	printTopErrors := func(title string, topErrors []flashback.ErrorCount) {
+		if len(topErrors) == 0 {
+			return
+		}
+		logger.Infof(title)
+		for _, e := range topErrors {
+			logger.Infof("   %d x %s (code %d): %s", e.Count, e.Category, e.Code, e.Message)
+		}
+	}
+
 	// Report on the status of each worker
 	report := func() {
+		// Taken once per report, since it starts a new interval
+		var dispatchStatus *flashback.DispatchStatus
+		if style == "real" || followsTargetRate() {
+			dispatchStatus = dispatchStats.GetStatus()
+		}
+
 		printStatus := func(status *flashback.ExecutionStatus, statsOut *os.File, name string) {
 			logger.Infof("[%s] Executed %d ops (%d in interval), got %d errors (%d in interval), "+
-				"%.2f ops/sec (total), %.2f ops/sec (interval)", name, status.OpsExecuted, status.IntervalOpsExecuted,
-				status.OpsErrors, status.IntervalOpsErrors, status.OpsPerSec, status.IntervalOpsPerSec)
+				"%d timeouts (%d in interval), %.2f ops/sec (total), %.2f ops/sec (interval)", name,
+				status.OpsExecuted, status.IntervalOpsExecuted, status.OpsErrors, status.IntervalOpsErrors,
+				status.OpsTimeouts, status.IntervalOpsTimeouts, status.OpsPerSec, status.IntervalOpsPerSec)
+			if followsTargetRate() {
+				logger.Infof("  Target rate: %.2f ops/sec", status.TargetOpsPerSec)
+			}
+			if status.Retries > 0 {
+				logger.Infof("  Retries: %d (%d in interval), ops failed after retrying: %d (%d in interval)",
+					status.Retries, status.IntervalRetries, status.RetriesExhausted, status.IntervalRetriesExhausted)
+			}
+			if status.Counts[flashback.Transaction] > 0 {
+				logger.Infof("  Transactions aborted: %d (%d in interval), abort rate: %.2f%% (total), %.2f%% (interval)",
+					status.TransactionsAborted, status.IntervalTransactionsAborted,
+					status.TransactionAbortRate*100, status.IntervalTransactionAbortRate*100)
+			}
 
 			var statsLineOutput string
 			if statsOut != nil {
@@ -415,6 +976,29 @@ func main() {
 				logger.Infof(template, "Interval", intervalLatencies[flashback.P50], intervalLatencies[flashback.P70],
 					intervalLatencies[flashback.P90], intervalLatencies[flashback.P95], intervalLatencies[flashback.P99],
 					status.IntervalMaxLatency[opType])
+				// The latencies above are service times. When ops follow a
+				// schedule, the time they wait for a worker counts too.
+				if style == "real" || followsTargetRate() {
+					responseTimes := status.ResponseTimes[opType]
+					intervalResponseTimes := status.IntervalResponseTimes[opType]
+					logger.Infof(template, "Total response", responseTimes[flashback.P50], responseTimes[flashback.P70],
+						responseTimes[flashback.P90], responseTimes[flashback.P95], responseTimes[flashback.P99],
+						status.MaxResponseTime[opType])
+					logger.Infof(template, "Interval response", intervalResponseTimes[flashback.P50],
+						intervalResponseTimes[flashback.P70], intervalResponseTimes[flashback.P90],
+						intervalResponseTimes[flashback.P95], intervalResponseTimes[flashback.P99],
+						status.IntervalMaxResponseTime[opType])
+				}
+				if errorCounts := status.ErrorCounts[opType]; len(errorCounts) > 0 {
+					var errorsOutput []string
+					for _, category := range flashback.AllErrorCategories {
+						if errorCounts[category] > 0 {
+							errorsOutput = append(errorsOutput, fmt.Sprintf("%s: %d (%d in interval)", category,
+								errorCounts[category], status.IntervalErrorCounts[opType][category]))
+						}
+					}
+					logger.Infof("   Errors: %s", strings.Join(errorsOutput, ", "))
+				}
 
 				if statsOut != nil {
 					statsLineOutput = fmt.Sprintf("%s,%d,%.2f", statsLineOutput,
@@ -422,15 +1006,50 @@ func main() {
 				}
 			}
 
+			printTopErrors("  Top errors in interval:", status.IntervalTopErrors)
+			if statsOut != nil && followsTargetRate() {
+				statsLineOutput = fmt.Sprintf("%s,%.2f", statsLineOutput, status.TargetOpsPerSec)
+			}
+			if statsOut != nil && style == "real" {
+				statsLineOutput = fmt.Sprintf("%s,%d,%d", statsLineOutput,
+					dispatchStatus.IntervalMaxLag.Milliseconds(), dispatchStatus.IntervalDropped)
+			}
+
 			// Write stats to disk at each interval for analysis later
 			// Format is:
 			// time,  ops, ops/sec, insert ops, inserts/sec, update ops, update/sec, remove ops, remove/sec,
-			// query ops, query/sec, count ops, count/sec, fam ops, fam/sec
+			// query ops, query/sec, count ops, count/sec, fam ops, fam/sec, aggregate ops, aggregate/sec,
+			// distinct ops, distinct/sec, createIndexes ops, createIndexes/sec, dropIndexes ops, dropIndexes/sec,
+			// geoNear ops, geoNear/sec, mapReduce ops, mapReduce/sec, collMod ops, collMod/sec,
+			// passthrough command ops, passthrough command/sec, transactions, transactions/sec
+			// followed, with a load profile (or a target rate), by: target ops/sec
+			// or, in "real" style, by: max lag behind the recording in ms, dropped ops
 			if statsOut != nil {
 				statsOut.WriteString(statsLineOutput + "\n")
 			}
 		}
 
+		if status := dispatchStatus; followsTargetRate() {
+			logger.Infof("Dispatched %d ops (%d in interval), %.2f ops/sec (total), %.2f ops/sec (interval), "+
+				"target: %.2f ops/sec, %d late (%d in interval), max lag: %v (%v in interval)",
+				status.Dispatched, status.IntervalDispatched, status.OpsPerSec, status.IntervalOpsPerSec,
+				status.TargetOpsPerSec, status.Late, status.IntervalLate, status.MaxLag, status.IntervalMaxLag)
+			if status.IntervalLate > 0 {
+				logger.Error(fmt.Sprintf("Can't keep up with the target rate of %.2f ops/sec: %d ops sent late "+
+					"in interval, %v behind schedule", status.TargetOpsPerSec, status.IntervalLate, status.Lag))
+			}
+		} else if status != nil {
+			logger.Infof("Dispatched %d ops (%d in interval), %.2f ops/sec (total), %.2f ops/sec (interval), "+
+				"%d late (%d in interval), %d dropped (%d in interval), lag behind the recording: %v, "+
+				"max lag: %v (%v in interval)",
+				status.Dispatched, status.IntervalDispatched, status.OpsPerSec, status.IntervalOpsPerSec,
+				status.Late, status.IntervalLate, status.Dropped, status.IntervalDropped, status.Lag,
+				status.MaxLag, status.IntervalMaxLag)
+			if status.IntervalLate > 0 && !status.Aborted {
+				logger.Error(fmt.Sprintf("Can't keep up with the recording at a speedup of %.2f: %d ops sent late "+
+					"in interval, %v behind the recording", speedup, status.IntervalLate, status.Lag))
+			}
+		}
 		for _, n := range nodes {
 			printStatus(n.statsAnalyzer.GetStatus(), n.statsFile, n.name)
 		}
@@ -452,6 +1071,52 @@ func main() {
 	}
 	reportTicker.Stop()
 
-	// Report one last time
+	// Report one last time, with the most frequent errors of the whole run
 	report()
+	for _, n := range nodes {
+		printTopErrors(fmt.Sprintf("[%s] Top errors:", n.name), n.statsAnalyzer.GetStatus().TopErrors)
+	}
+
+	// Report the commands that weren't replayed natively
+	printCommandCounts := func(title string, counts map[string]int64) {
+		if len(counts) == 0 {
+			return
+		}
+		names := make([]string, 0, len(counts))
+		for name := range counts {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		logger.Infof("%s:", title)
+		for _, name := range names {
+			logger.Infof("  %s: %d", name, counts[name])
+		}
+	}
+	printCommandCounts("Skipped commands", skippedOps.Counts())
+	printCommandCounts("Passthrough commands", passthroughOps.Counts())
+
+	// The profiler often doesn't record commitTransaction, so say how many
+	// transactions had to be assumed to commit
+	if neverEnded := transactions.NeverEnded(); neverEnded > 0 {
+		logger.Warningf("%d transactions never ended in the ops file, they were committed", neverEnded)
+	}
+
+	// Summarize the result verification
+	for _, n := range nodes {
+		if n.verifier == nil {
+			continue
+		}
+		verified, mismatches := n.verifier.Counts()
+		var totalVerified, totalMismatches int64
+		for _, opType := range flashback.AllOpTypes {
+			totalVerified += verified[opType]
+			totalMismatches += mismatches[opType]
+		}
+		logger.Infof("[%s] Verified the results of %d ops, %d mismatches", n.name, totalVerified, totalMismatches)
+		for _, opType := range flashback.AllOpTypes {
+			if verified[opType] > 0 {
+				logger.Infof("  Op type: %s, verified: %d, mismatches: %d", opType, verified[opType], mismatches[opType])
+			}
+		}
+	}
 }
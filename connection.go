@@ -0,0 +1,144 @@
+package flashback
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The mechanism that authenticates with the TLS client certificate.
+const x509Mechanism = "MONGODB-X509"
+
+// ConnectionOptions describes how to connect to a node. Authentication and
+// TLS can be given either in the connection string or in the dedicated
+// fields, which take precedence.
+type ConnectionOptions struct {
+	// Either <host>[:<port>] or a mongodb:// connection string
+	Url string
+
+	// SCRAM or x.509 credentials. The mechanism is negotiated with the
+	// server when it isn't set.
+	Username      string
+	Password      string
+	AuthSource    string
+	AuthMechanism string
+
+	// TLS is turned on by any of the TLS fields. The certificate key file
+	// holds both the client certificate and its private key, as for mongod.
+	TLS                   bool
+	TLSCAFile             string
+	TLSCertificateKeyFile string
+
+	// Size of the connection pool, 0 for the driver's default
+	PoolSize      int
+	SocketTimeout time.Duration
+}
+
+// Turn a url into a connection string. Bare <host>[:<port>] values are
+// still accepted.
+func connectionString(url string) string {
+	if url == "" {
+		url = "localhost:27017"
+	}
+	if strings.HasPrefix(url, "mongodb://") || strings.HasPrefix(url, "mongodb+srv://") {
+		return url
+	}
+	return "mongodb://" + url
+}
+
+// ClientOptions builds the driver options for the node.
+func (c *ConnectionOptions) ClientOptions() (*options.ClientOptions, error) {
+	opts := options.Client()
+	if c.PoolSize > 0 {
+		opts.SetMaxPoolSize(uint64(c.PoolSize))
+	}
+	if c.SocketTimeout > 0 {
+		opts.SetSocketTimeout(c.SocketTimeout)
+	}
+	opts.ApplyURI(connectionString(c.Url))
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	if c.Username != "" || c.Password != "" || c.AuthSource != "" || c.AuthMechanism != "" {
+		credential := options.Credential{}
+		if opts.Auth != nil {
+			credential = *opts.Auth
+		}
+		if c.Username != "" {
+			credential.Username = c.Username
+		}
+		if c.Password != "" {
+			credential.Password = c.Password
+			credential.PasswordSet = true
+		}
+		if c.AuthSource != "" {
+			credential.AuthSource = c.AuthSource
+		}
+		if c.AuthMechanism != "" {
+			credential.AuthMechanism = strings.ToUpper(c.AuthMechanism)
+		}
+		if credential.AuthMechanism == x509Mechanism && c.TLSCertificateKeyFile == "" && opts.TLSConfig == nil {
+			return nil, errors.New("x.509 authentication requires a TLS client certificate")
+		}
+		opts.SetAuth(credential)
+	}
+
+	if c.TLS || c.TLSCAFile != "" || c.TLSCertificateKeyFile != "" {
+		config, err := c.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		opts.SetTLSConfig(config)
+	}
+	return opts, nil
+}
+
+func (c *ConnectionOptions) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{}
+	if c.TLSCAFile != "" {
+		pem, err := ioutil.ReadFile(c.TLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", c.TLSCAFile)
+		}
+	}
+	if c.TLSCertificateKeyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(c.TLSCertificateKeyFile, c.TLSCertificateKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+	return config, nil
+}
+
+// Connect to a node, and make sure it's reachable and that we are
+// authenticated, so that a misconfigured node is reported up front rather
+// than as failed ops.
+func Connect(c *ConnectionOptions) (*mongo.Client, error) {
+	opts, err := c.ClientOptions()
+	if err != nil {
+		return nil, err
+	}
+	client, err := mongo.Connect(context.Background(), opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := client.Ping(context.Background(), nil); err != nil {
+		client.Disconnect(context.Background())
+		return nil, err
+	}
+	return client, nil
+}
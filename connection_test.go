@@ -0,0 +1,117 @@
+package flashback
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+// Hook up gocheck into the "go test" runner.
+func TestConnection(t *testing.T) {
+	TestingT(t)
+}
+
+type TestConnectionSuite struct{}
+
+var _ = Suite(&TestConnectionSuite{})
+
+// Write a self-signed certificate and its key in a single PEM file, the way
+// mongod expects client certificates.
+func writeCertificateKeyFile(c *C, dir string) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "flashback"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	c.Assert(err, IsNil)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	c.Assert(err, IsNil)
+
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	data = append(data, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})...)
+	filename := filepath.Join(dir, "client.pem")
+	c.Assert(ioutil.WriteFile(filename, data, 0600), IsNil)
+	return filename
+}
+
+func (s *TestConnectionSuite) TestConnectionString(c *C) {
+	c.Assert(connectionString(""), Equals, "mongodb://localhost:27017")
+	c.Assert(connectionString("db1:27018"), Equals, "mongodb://db1:27018")
+	c.Assert(connectionString("mongodb://u:p@db1,db2/?replicaSet=rs0"), Equals, "mongodb://u:p@db1,db2/?replicaSet=rs0")
+	c.Assert(connectionString("mongodb+srv://cluster.example.com"), Equals, "mongodb+srv://cluster.example.com")
+}
+
+func (s *TestConnectionSuite) TestAuthentication(c *C) {
+	// no credentials
+	opts, err := (&ConnectionOptions{Url: "db1"}).ClientOptions()
+	c.Assert(err, IsNil)
+	c.Assert(opts.Auth, IsNil)
+	c.Assert(opts.TLSConfig, IsNil)
+
+	// SCRAM
+	opts, err = (&ConnectionOptions{Url: "db1", Username: "bench", Password: "secret", AuthSource: "app"}).ClientOptions()
+	c.Assert(err, IsNil)
+	c.Assert(opts.Auth.Username, Equals, "bench")
+	c.Assert(opts.Auth.Password, Equals, "secret")
+	c.Assert(opts.Auth.AuthSource, Equals, "app")
+	c.Assert(opts.Auth.AuthMechanism, Equals, "")
+
+	// the options take precedence over the connection string
+	opts, err = (&ConnectionOptions{Url: "mongodb://u:p@db1/?authSource=app", Password: "other",
+		AuthMechanism: "scram-sha-256"}).ClientOptions()
+	c.Assert(err, IsNil)
+	c.Assert(opts.Auth.Username, Equals, "u")
+	c.Assert(opts.Auth.Password, Equals, "other")
+	c.Assert(opts.Auth.AuthSource, Equals, "app")
+	c.Assert(opts.Auth.AuthMechanism, Equals, "SCRAM-SHA-256")
+
+	// x.509 needs a client certificate
+	_, err = (&ConnectionOptions{Url: "db1", AuthMechanism: "MONGODB-X509"}).ClientOptions()
+	c.Assert(err, NotNil)
+}
+
+func (s *TestConnectionSuite) TestTLS(c *C) {
+	dir := c.MkDir()
+	certificateKeyFile := writeCertificateKeyFile(c, dir)
+
+	opts, err := (&ConnectionOptions{Url: "db1", TLS: true}).ClientOptions()
+	c.Assert(err, IsNil)
+	c.Assert(opts.TLSConfig, NotNil)
+	c.Assert(opts.TLSConfig.RootCAs, IsNil)
+
+	// the same file is used as the CA and as the client certificate
+	opts, err = (&ConnectionOptions{Url: "db1", TLSCAFile: certificateKeyFile,
+		TLSCertificateKeyFile: certificateKeyFile, AuthMechanism: "MONGODB-X509"}).ClientOptions()
+	c.Assert(err, IsNil)
+	c.Assert(opts.TLSConfig.RootCAs, NotNil)
+	c.Assert(len(opts.TLSConfig.Certificates), Equals, 1)
+	c.Assert(opts.Auth.AuthMechanism, Equals, "MONGODB-X509")
+
+	// missing or invalid files are reported
+	_, err = (&ConnectionOptions{Url: "db1", TLSCAFile: filepath.Join(dir, "missing.pem")}).ClientOptions()
+	c.Assert(err, NotNil)
+	invalid := filepath.Join(dir, "invalid.pem")
+	c.Assert(ioutil.WriteFile(invalid, []byte("not a certificate"), 0600), IsNil)
+	_, err = (&ConnectionOptions{Url: "db1", TLSCAFile: invalid}).ClientOptions()
+	c.Assert(err, NotNil)
+	_, err = (&ConnectionOptions{Url: "db1", TLSCertificateKeyFile: invalid}).ClientOptions()
+	c.Assert(err, NotNil)
+}
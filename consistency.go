@@ -0,0 +1,136 @@
+package flashback
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+	"go.mongodb.org/mongo-driver/tag"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Consistency describes the write concern, read preference and read concern
+// that ops are replayed with against a node. The zero value uses the server
+// defaults, and reads from the primary.
+type Consistency struct {
+	// Write concern. W is either a number of nodes or a mode such as
+	// "majority"; the write concern is left to the server if W is empty and
+	// J and WTimeoutMs aren't set.
+	W          string
+	J          bool
+	WTimeoutMs int
+
+	// Replay the write concern recorded with each op, when there is one,
+	// instead of the one above.
+	ReplayWriteConcern bool
+
+	// Read preference mode (e.g. "secondaryPreferred") and tag sets, in the
+	// format "dc:east,rack:1;dc:west" where sets are tried in order. When
+	// the mode is empty, the read preference recorded with queries is used.
+	ReadPreference     string
+	ReadPreferenceTags string
+
+	// Read concern level, e.g. "majority"
+	ReadConcern string
+}
+
+// Validate checks that the read preference can be built.
+func (c *Consistency) Validate() error {
+	_, err := c.readPreference()
+	return err
+}
+
+// The write concern document, or nil to leave it to the server.
+func (c *Consistency) writeConcern() interface{} {
+	writeConcern := bson.D{}
+	if c.W != "" {
+		if w, err := strconv.Atoi(c.W); err == nil {
+			writeConcern = append(writeConcern, bson.DocElem{Name: "w", Value: w})
+		} else {
+			writeConcern = append(writeConcern, bson.DocElem{Name: "w", Value: c.W})
+		}
+	}
+	if c.J {
+		writeConcern = append(writeConcern, bson.DocElem{Name: "j", Value: true})
+	}
+	if c.WTimeoutMs > 0 {
+		writeConcern = append(writeConcern, bson.DocElem{Name: "wtimeout", Value: c.WTimeoutMs})
+	}
+	if len(writeConcern) == 0 {
+		return nil
+	}
+	return writeConcern
+}
+
+// Turn a write concern document, as built by writeConcern or recorded with an
+// op, into the driver's write concern.
+func driverWriteConcern(doc interface{}) *writeconcern.WriteConcern {
+	recorded, ok := asMap(doc)
+	if !ok {
+		return nil
+	}
+	writeConcern := &writeconcern.WriteConcern{}
+	if w, ok := recorded["w"].(string); ok {
+		writeConcern.W = w
+	} else if w, err := safeGetInt(recorded["w"]); err == nil {
+		writeConcern.W = w
+	}
+	if j, ok := recorded["j"].(bool); ok {
+		writeConcern.Journal = &j
+	}
+	if wtimeout, err := safeGetInt(recorded["wtimeout"]); err == nil {
+		writeConcern.WTimeout = time.Duration(wtimeout) * time.Millisecond
+	}
+	return writeConcern
+}
+
+// The read preference, or nil if none was given.
+func (c *Consistency) readPreference() (*readpref.ReadPref, error) {
+	if c.ReadPreference == "" {
+		if c.ReadPreferenceTags != "" {
+			return nil, fmt.Errorf("read preference tags require a read preference mode")
+		}
+		return nil, nil
+	}
+	mode, ok := readPreferenceModes[c.ReadPreference]
+	if !ok {
+		return nil, fmt.Errorf("unknown read preference: %s", c.ReadPreference)
+	}
+	tagSets, err := parseTagSets(c.ReadPreferenceTags)
+	if err != nil {
+		return nil, err
+	}
+	if len(tagSets) > 0 {
+		return readpref.New(mode, readpref.WithTagSets(tagSets...))
+	}
+	return readpref.New(mode)
+}
+
+// Parse tag sets such as "dc:east,rack:1;dc:west".
+func parseTagSets(text string) ([]tag.Set, error) {
+	tagSets := []tag.Set{}
+	if text == "" {
+		return tagSets, nil
+	}
+	for _, setText := range strings.Split(text, ";") {
+		tagSet := tag.Set{}
+		for _, tagText := range strings.Split(setText, ",") {
+			if strings.TrimSpace(tagText) == "" {
+				continue
+			}
+			parts := strings.SplitN(tagText, ":", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("invalid read preference tag: %s", tagText)
+			}
+			tagSet = append(tagSet, tag.Tag{
+				Name:  strings.TrimSpace(parts[0]),
+				Value: strings.TrimSpace(parts[1]),
+			})
+		}
+		tagSets = append(tagSets, tagSet)
+	}
+	return tagSets, nil
+}
@@ -0,0 +1,149 @@
+package flashback
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// The positions of the records skipped or rejected for the same reason that
+// are kept, to point at them
+const maxIssuePositions = 10
+
+// IssueCount counts the records of an op type that are skipped or rejected
+// for the same reason.
+type IssueCount struct {
+	OpType    OpType
+	Rejected  bool
+	Reason    string
+	Count     int64
+	Positions []int // the first ones, see Op.Position
+}
+
+// DryRunExecutor takes the place of OpsExecutor to check that the ops of a
+// file can be replayed, without sending them anywhere. It counts the ops that
+// would be executed, and the records that are skipped or rejected, by reason.
+// It is safe to use from multiple goroutines.
+type DryRunExecutor struct {
+	executed map[OpType]int64
+	issues   map[OpIssue]*IssueCount // by issue, without its position
+	mutex    *sync.Mutex
+}
+
+func NewDryRunExecutor() *DryRunExecutor {
+	return &DryRunExecutor{
+		executed: make(map[OpType]int64),
+		issues:   make(map[OpIssue]*IssueCount),
+		mutex:    &sync.Mutex{},
+	}
+}
+
+// Execute checks an op the way OpsExecutor would execute it. The op is
+// rejected, and NotSupported returned, if it can't be replayed.
+func (e *DryRunExecutor) Execute(op *Op) error {
+	if reason := checkOp(op); reason != "" {
+		e.Report(OpIssue{Position: op.Position, OpType: op.Type, Rejected: true, Reason: reason})
+		return NotSupported
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.executed[op.Type]++
+	return nil
+}
+
+// LastLatency is always 0, since nothing is sent.
+func (e *DryRunExecutor) LastLatency() time.Duration {
+	return 0
+}
+
+func (e *DryRunExecutor) Close() {
+}
+
+// Report records an op that isn't executed, e.g. one skipped by a reader.
+func (e *DryRunExecutor) Report(issue OpIssue) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	position := issue.Position
+	issue.Position = 0
+	count, ok := e.issues[issue]
+	if !ok {
+		count = &IssueCount{OpType: issue.OpType, Rejected: issue.Rejected, Reason: issue.Reason}
+		e.issues[issue] = count
+	}
+	count.Count++
+	if len(count.Positions) < maxIssuePositions {
+		count.Positions = append(count.Positions, position)
+	}
+}
+
+// Executed returns how many ops would be executed, by op type.
+func (e *DryRunExecutor) Executed() map[OpType]int64 {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	executed := make(map[OpType]int64, len(e.executed))
+	for opType, count := range e.executed {
+		executed[opType] = count
+	}
+	return executed
+}
+
+// Issues returns the records that were skipped or rejected, counted by op
+// type and reason, sorted by op type and then by decreasing count.
+func (e *DryRunExecutor) Issues() []IssueCount {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	issues := make([]IssueCount, 0, len(e.issues))
+	for _, count := range e.issues {
+		copied := *count
+		copied.Positions = append([]int(nil), count.Positions...)
+		issues = append(issues, copied)
+	}
+	sort.Slice(issues, func(i, j int) bool {
+		a, b := issues[i], issues[j]
+		if a.OpType != b.OpType {
+			return a.OpType < b.OpType
+		}
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return a.Reason < b.Reason
+	})
+	return issues
+}
+
+// Tell why OpsExecutor couldn't replay an op, or return an empty string if it
+// could.
+func checkOp(op *Op) string {
+	switch op.Type {
+	case Insert:
+		if op.Content["o"] == nil {
+			return "insert without documents"
+		}
+	case Update:
+		if op.Content["updateobj"] == nil {
+			return "update without an update document"
+		}
+	case Aggregate:
+		if _, ok := op.Content["pipeline"].([]interface{}); !ok {
+			return "aggregate without a pipeline"
+		}
+	case Command:
+		if len(orderedCommand(op.Content["command"])) == 0 {
+			return "command whose name can't be told"
+		}
+	case Transaction:
+		for _, txnOp := range op.Ops {
+			if reason := checkOp(txnOp); reason != "" {
+				return "in transaction: " + reason
+			}
+		}
+	case Query, Remove, Count, FindAndModify, Distinct, CreateIndexes, DropIndexes, GeoNear, MapReduce, CollMod:
+	default:
+		return "unsupported op type"
+	}
+	return ""
+}
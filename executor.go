@@ -0,0 +1,149 @@
+package flashback
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Executor replays ops against a node. Each worker has its own executor for
+// each node, so an executor is used from a single goroutine at a time.
+//
+// Executors report each op they execute as an OpStat on the stats channel of
+// their node, see BackendOptions.
+type Executor interface {
+	// Execute an op and return its error, if any.
+	Execute(op *Op) error
+
+	// How long the last op took.
+	LastLatency() time.Duration
+
+	// Release what the executor holds. It isn't used afterwards.
+	Close()
+}
+
+// ResultExecutor is implemented by the executors that keep the result of the
+// last op, so that it can be verified, see ResultVerifier.
+type ResultExecutor interface {
+	Executor
+
+	// The result of the last op, or nil if it didn't get one.
+	LastResult() interface{}
+}
+
+// BackendOptions tell a backend how to reach a node and how to replay the ops
+// against it.
+type BackendOptions struct {
+	Connection  ConnectionOptions
+	Consistency *Consistency
+	Timeouts    *Timeouts
+	RetryPolicy RetryPolicy
+	StatsChan   chan OpStat
+	Logger      *Logger
+}
+
+// Backend connects to a node and creates the executors of the workers.
+type Backend interface {
+	NewExecutor() (Executor, error)
+
+	// Disconnect from the node, once its executors are closed.
+	Close()
+}
+
+// BackendFactory opens a backend, see RegisterBackend.
+type BackendFactory func(options *BackendOptions) (Backend, error)
+
+var (
+	backends      = map[string]BackendFactory{}
+	backendsMutex = &sync.Mutex{}
+)
+
+// The backend the ops are replayed with by default: OpsExecutor, which is
+// also picked for mongodb+srv:// urls.
+const defaultBackend = "mongodb"
+
+func init() {
+	RegisterBackend(defaultBackend, newMongoBackend)
+	RegisterBackend("mongodb+srv", newMongoBackend)
+}
+
+// RegisterBackend makes a backend available under a name, which is also the
+// url scheme that selects it, e.g. "mongodb" for "mongodb://host:27017".
+// Registering a name again replaces its backend.
+func RegisterBackend(name string, factory BackendFactory) {
+	backendsMutex.Lock()
+	defer backendsMutex.Unlock()
+	backends[name] = factory
+}
+
+// Backends lists the names of the registered backends, sorted.
+func Backends() []string {
+	backendsMutex.Lock()
+	defer backendsMutex.Unlock()
+
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// OpenBackend opens the named backend or, if name is empty, the backend
+// matching the scheme of the node's url. Urls without a scheme, such as
+// "localhost:27017", are replayed against with the mongodb backend.
+func OpenBackend(name string, options *BackendOptions) (Backend, error) {
+	if name == "" {
+		name = defaultBackend
+		if i := strings.Index(options.Connection.Url, "://"); i > 0 {
+			name = options.Connection.Url[:i]
+		}
+	}
+
+	backendsMutex.Lock()
+	factory, ok := backends[name]
+	backendsMutex.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown backend: %s", name)
+	}
+	return factory(options)
+}
+
+// The backend of OpsExecutor. Its client is shared by the executors.
+type mongoBackend struct {
+	client  *mongo.Client
+	options *BackendOptions
+}
+
+func newMongoBackend(options *BackendOptions) (Backend, error) {
+	client, err := Connect(&options.Connection)
+	if err != nil {
+		return nil, err
+	}
+	return &mongoBackend{client: client, options: options}, nil
+}
+
+func (b *mongoBackend) NewExecutor() (Executor, error) {
+	exec := NewOpsExecutor(b.client, b.options.StatsChan, b.options.Logger)
+	if b.options.Consistency != nil {
+		if err := exec.SetConsistency(b.options.Consistency); err != nil {
+			return nil, err
+		}
+	}
+	if b.options.Timeouts != nil {
+		exec.SetTimeouts(b.options.Timeouts)
+	}
+	if b.options.RetryPolicy != nil {
+		exec.SetRetryPolicy(b.options.RetryPolicy)
+	}
+	return exec, nil
+}
+
+func (b *mongoBackend) Close() {
+	b.client.Disconnect(context.Background())
+}
@@ -0,0 +1,323 @@
+package flashback
+
+import (
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Fields whose key order matters when an op is replayed: sorts, hints and
+// aggregation pipelines. Index keys and the command document itself, whose
+// first key is the name of the command, are handled separately.
+var orderedFields = []string{"$orderby", "$hint", "sort", "hint", "pipeline"}
+
+// keyOrder records the order of the keys of a document, and recursively the
+// order of the keys of the documents nested in it.
+type keyOrder struct {
+	// keys of a document, in order
+	keys []string
+	// key orders of the documents and arrays nested in a document, by key
+	items map[string]*keyOrder
+	// key orders of the elements of an array
+	elems []*keyOrder
+}
+
+// Get the key order of a document that has been decoded as a bson.D.
+func keyOrderOfD(value interface{}) *keyOrder {
+	switch v := value.(type) {
+	case bson.D:
+		order := &keyOrder{items: make(map[string]*keyOrder)}
+		for _, elem := range v {
+			order.keys = append(order.keys, elem.Name)
+			if child := keyOrderOfD(elem.Value); child != nil {
+				order.items[elem.Name] = child
+			}
+		}
+		return order
+	case []interface{}:
+		order := &keyOrder{}
+		for _, elem := range v {
+			order.elems = append(order.elems, keyOrderOfD(elem))
+		}
+		return order
+	}
+	return nil
+}
+
+// Get the key order of a JSON document by scanning its text. Only the
+// structure of the text is looked at; values are skipped, so this works with
+// the shell-style extensions (e.g. NumberInt(1)) mongo's JSON parser allows.
+// The text is expected to be valid, i.e. to have been parsed successfully.
+func scanKeyOrder(text string) *keyOrder {
+	s := &keyOrderScanner{text: text}
+	return s.value()
+}
+
+type keyOrderScanner struct {
+	text string
+	pos  int
+}
+
+func (s *keyOrderScanner) skipSpace() {
+	for s.pos < len(s.text) {
+		switch s.text[s.pos] {
+		case ' ', '\t', '\r', '\n':
+			s.pos++
+		default:
+			return
+		}
+	}
+}
+
+func (s *keyOrderScanner) value() *keyOrder {
+	s.skipSpace()
+	if s.pos >= len(s.text) {
+		return nil
+	}
+	switch s.text[s.pos] {
+	case '{':
+		return s.object()
+	case '[':
+		return s.array()
+	case '"', '\'':
+		s.str()
+		return nil
+	}
+	start := s.pos
+	s.scalar()
+	if s.pos == start {
+		// stray character, make sure we keep moving
+		s.pos++
+	}
+	return nil
+}
+
+func (s *keyOrderScanner) object() *keyOrder {
+	order := &keyOrder{items: make(map[string]*keyOrder)}
+	s.pos++
+	for {
+		s.skipSpace()
+		if s.pos >= len(s.text) {
+			return order
+		}
+		switch s.text[s.pos] {
+		case '}':
+			s.pos++
+			return order
+		case ',':
+			s.pos++
+			continue
+		}
+
+		var key string
+		if c := s.text[s.pos]; c == '"' || c == '\'' {
+			key = s.str()
+		} else {
+			key = s.unquotedKey()
+		}
+		order.keys = append(order.keys, key)
+
+		// a key without a value is kept, but what follows it isn't a value
+		s.skipSpace()
+		if s.pos >= len(s.text) || s.text[s.pos] != ':' {
+			continue
+		}
+		s.pos++
+		if child := s.value(); child != nil {
+			order.items[key] = child
+		}
+	}
+}
+
+// Skip an unquoted key and return it. It ends at whitespace or at any of the
+// JSON delimiters.
+func (s *keyOrderScanner) unquotedKey() string {
+	start := s.pos
+	for s.pos < len(s.text) {
+		switch s.text[s.pos] {
+		case ':', ',', '{', '}', '[', ']', ' ', '\t', '\r', '\n':
+			if s.pos == start {
+				// stray delimiter, make sure we keep moving
+				s.pos++
+			}
+			return s.text[start:s.pos]
+		}
+		s.pos++
+	}
+	return s.text[start:s.pos]
+}
+
+func (s *keyOrderScanner) array() *keyOrder {
+	order := &keyOrder{}
+	s.pos++
+	for {
+		s.skipSpace()
+		if s.pos >= len(s.text) {
+			return order
+		}
+		switch s.text[s.pos] {
+		case ']':
+			s.pos++
+			return order
+		case ',':
+			s.pos++
+			continue
+		}
+		order.elems = append(order.elems, s.value())
+	}
+}
+
+// Skip a quoted string and return its content.
+func (s *keyOrderScanner) str() string {
+	quote := s.text[s.pos]
+	s.pos++
+	start := s.pos
+	for s.pos < len(s.text) && s.text[s.pos] != quote {
+		if s.text[s.pos] == '\\' {
+			s.pos++
+		}
+		s.pos++
+	}
+	end := s.pos
+	if end > len(s.text) {
+		end = len(s.text)
+	}
+	s.pos++
+	return s.text[start:end]
+}
+
+// Skip a scalar such as a number, true, null or NumberLong("1").
+func (s *keyOrderScanner) scalar() {
+	depth := 0
+	for s.pos < len(s.text) {
+		switch s.text[s.pos] {
+		case '"', '\'':
+			s.str()
+			continue
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',', '}', ']':
+			if depth <= 0 {
+				return
+			}
+		}
+		s.pos++
+	}
+}
+
+// Convert a map into a bson.D following the given key order. If deep is true,
+// the documents nested in it are converted as well. Keys that are missing
+// from the order are appended at the end.
+func orderDocument(doc map[string]interface{}, order *keyOrder, deep bool) bson.D {
+	ordered := make(bson.D, 0, len(doc))
+	seen := make(map[string]bool, len(doc))
+	for _, key := range order.keys {
+		value, exist := doc[key]
+		if !exist || seen[key] {
+			continue
+		}
+		seen[key] = true
+		if deep {
+			value = orderedValue(value, order.items[key])
+		}
+		ordered = append(ordered, bson.DocElem{Name: key, Value: value})
+	}
+	for key, value := range doc {
+		if !seen[key] {
+			ordered = append(ordered, bson.DocElem{Name: key, Value: value})
+		}
+	}
+	return ordered
+}
+
+// Convert all the documents in a value into bson.D following the given key
+// order.
+func orderedValue(value interface{}, order *keyOrder) interface{} {
+	if order == nil {
+		return value
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return orderDocument(v, order, true)
+	case []interface{}:
+		ordered := make([]interface{}, len(v))
+		for i, elem := range v {
+			var elemOrder *keyOrder
+			if i < len(order.elems) {
+				elemOrder = order.elems[i]
+			}
+			ordered[i] = orderedValue(elem, elemOrder)
+		}
+		return ordered
+	}
+	return value
+}
+
+// Check whether the replay of a raw op depends on the order of its keys.
+func needsKeyOrder(rawDoc Document) bool {
+	if rawDoc["command"] != nil {
+		return true
+	}
+	query, ok := rawDoc["query"].(map[string]interface{})
+	if !ok {
+		return false
+	}
+	for _, field := range orderedFields {
+		if query[field] != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Replace the parts of a raw op whose key order matters by bson.D, so that
+// they are replayed exactly as they were recorded.
+func preserveKeyOrder(rawDoc Document, order *keyOrder) {
+	if order == nil {
+		return
+	}
+	if query, ok := rawDoc["query"].(map[string]interface{}); ok {
+		orderFields(query, order.items["query"])
+	}
+
+	cmd, ok := rawDoc["command"].(map[string]interface{})
+	cmdOrder := order.items["command"]
+	if !ok || cmdOrder == nil {
+		return
+	}
+	orderFields(cmd, cmdOrder)
+	if indexes, ok := cmd["indexes"].([]interface{}); ok && cmdOrder.items["indexes"] != nil {
+		indexOrders := cmdOrder.items["indexes"].elems
+		for i, index := range indexes {
+			spec, ok := index.(map[string]interface{})
+			if !ok || i >= len(indexOrders) || indexOrders[i] == nil {
+				continue
+			}
+			spec["key"] = orderedValue(spec["key"], indexOrders[i].items["key"])
+		}
+	}
+	rawDoc["command"] = orderDocument(cmd, cmdOrder, false)
+}
+
+func orderFields(doc map[string]interface{}, order *keyOrder) {
+	if order == nil {
+		return
+	}
+	for _, field := range orderedFields {
+		if doc[field] != nil {
+			doc[field] = orderedValue(doc[field], order.items[field])
+		}
+	}
+}
+
+// Get a document as a map, whether it has been decoded as a map or, to keep
+// the order of its keys, as a bson.D.
+func asMap(doc interface{}) (map[string]interface{}, bool) {
+	switch d := doc.(type) {
+	case map[string]interface{}:
+		return d, true
+	case bson.D:
+		return map[string]interface{}(d.Map()), true
+	}
+	return nil, false
+}
@@ -0,0 +1,207 @@
+package flashback
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LoadProfile gives the rate ops are sent at over the course of a run, see
+// NewLoadProfileOpsDispatcher.
+type LoadProfile interface {
+	// The target rate, in ops/sec, at the given time since the start of
+	// the run, or false once the profile is over.
+	Rate(elapsed time.Duration) (float64, bool)
+}
+
+// RampProfile grows (or shrinks) the rate linearly from From to To over
+// Over, then keeps it at To.
+type RampProfile struct {
+	From float64
+	To   float64
+	Over time.Duration
+}
+
+func (p *RampProfile) Rate(elapsed time.Duration) (float64, bool) {
+	if elapsed >= p.Over {
+		return p.To, true
+	}
+	return p.From + (p.To-p.From)*float64(elapsed)/float64(p.Over), true
+}
+
+// StepProfile starts at From, and adds Step to the rate Every so often, up to
+// Max if it isn't 0.
+type StepProfile struct {
+	From  float64
+	Step  float64
+	Every time.Duration
+	Max   float64
+}
+
+func (p *StepProfile) Rate(elapsed time.Duration) (float64, bool) {
+	rate := p.From + p.Step*float64(elapsed/p.Every)
+	if p.Max > 0 && rate > p.Max {
+		rate = p.Max
+	}
+	return rate, true
+}
+
+// SineProfile makes the rate oscillate around Mean, by Amplitude, with the
+// given Period. The rate never goes below 0.
+type SineProfile struct {
+	Mean      float64
+	Amplitude float64
+	Period    time.Duration
+}
+
+func (p *SineProfile) Rate(elapsed time.Duration) (float64, bool) {
+	rate := p.Mean + p.Amplitude*math.Sin(2*math.Pi*float64(elapsed)/float64(p.Period))
+	return math.Max(rate, 0), true
+}
+
+// RatePoint is the target rate at a given time of a run.
+type RatePoint struct {
+	Elapsed   time.Duration
+	OpsPerSec float64
+}
+
+// PointsProfile interpolates linearly between rates given at points in time,
+// sorted by time. The profile is over after its last point.
+type PointsProfile struct {
+	Points []RatePoint
+}
+
+func (p *PointsProfile) Rate(elapsed time.Duration) (float64, bool) {
+	for i, point := range p.Points {
+		if elapsed > point.Elapsed {
+			continue
+		}
+		if i == 0 || elapsed == point.Elapsed {
+			return point.OpsPerSec, true
+		}
+		previous := p.Points[i-1]
+		ratio := float64(elapsed-previous.Elapsed) / float64(point.Elapsed-previous.Elapsed)
+		return previous.OpsPerSec + (point.OpsPerSec-previous.OpsPerSec)*ratio, true
+	}
+	return 0, false
+}
+
+// ReadCSVProfile reads a PointsProfile from a CSV file of "seconds,ops_per_sec"
+// lines, e.g. "300,2000" for 2000 ops/sec 5 minutes into the run. A header
+// line is allowed.
+func ReadCSVProfile(filename string) (*PointsProfile, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	profile := &PointsProfile{}
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		fields := strings.Split(line, ",")
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected seconds,ops_per_sec", filename, lineNumber)
+		}
+		seconds, err := strconv.ParseFloat(strings.TrimSpace(fields[0]), 64)
+		if err != nil && lineNumber == 1 {
+			continue // header
+		}
+		rate, rateErr := strconv.ParseFloat(strings.TrimSpace(fields[1]), 64)
+		if err != nil || rateErr != nil || seconds < 0 || rate < 0 {
+			return nil, fmt.Errorf("%s:%d: invalid point: %s", filename, lineNumber, line)
+		}
+		point := RatePoint{time.Duration(seconds * float64(time.Second)), rate}
+		if n := len(profile.Points); n > 0 && point.Elapsed <= profile.Points[n-1].Elapsed {
+			return nil, fmt.Errorf("%s:%d: points must be sorted by time", filename, lineNumber)
+		}
+		profile.Points = append(profile.Points, point)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(profile.Points) == 0 {
+		return nil, fmt.Errorf("%s: no points", filename)
+	}
+	return profile, nil
+}
+
+// ParseLoadProfile parses the description of a load profile, one of:
+//
+//	ramp:from=1000,to=20000,over=10m
+//	steps:from=2000,step=2000,every=5m[,max=40000]
+//	sine:mean=10000,amplitude=5000,period=1m
+//	csv:<file>, see ReadCSVProfile
+func ParseLoadProfile(text string) (LoadProfile, error) {
+	parts := strings.SplitN(text, ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid load profile: %s", text)
+	}
+	kind, spec := parts[0], parts[1]
+	if kind == "csv" {
+		return ReadCSVProfile(spec)
+	}
+
+	params := make(map[string]string)
+	for _, param := range strings.Split(spec, ",") {
+		keyValue := strings.SplitN(param, "=", 2)
+		if len(keyValue) != 2 {
+			return nil, fmt.Errorf("invalid load profile parameter: %s", param)
+		}
+		params[strings.TrimSpace(keyValue[0])] = strings.TrimSpace(keyValue[1])
+	}
+	var err error
+	rate := func(name string, required bool) float64 {
+		value, ok := params[name]
+		delete(params, name)
+		if !ok {
+			if required && err == nil {
+				err = fmt.Errorf("missing load profile parameter: %s", name)
+			}
+			return 0
+		}
+		rate, parseErr := strconv.ParseFloat(value, 64)
+		if (parseErr != nil || rate < 0) && err == nil {
+			err = fmt.Errorf("invalid %s: %s", name, value)
+		}
+		return rate
+	}
+	duration := func(name string) time.Duration {
+		value, ok := params[name]
+		delete(params, name)
+		d, parseErr := time.ParseDuration(value)
+		if (!ok || parseErr != nil || d <= 0) && err == nil {
+			err = fmt.Errorf("invalid or missing %s: %s", name, value)
+		}
+		return d
+	}
+
+	var profile LoadProfile
+	switch kind {
+	case "ramp":
+		profile = &RampProfile{From: rate("from", true), To: rate("to", true), Over: duration("over")}
+	case "steps":
+		profile = &StepProfile{From: rate("from", true), Step: rate("step", true), Every: duration("every"),
+			Max: rate("max", false)}
+	case "sine":
+		profile = &SineProfile{Mean: rate("mean", true), Amplitude: rate("amplitude", true),
+			Period: duration("period")}
+	default:
+		return nil, fmt.Errorf("unknown load profile: %s", kind)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for name := range params {
+		return nil, fmt.Errorf("unknown load profile parameter: %s", name)
+	}
+	return profile, nil
+}
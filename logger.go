@@ -8,6 +8,7 @@ import (
 // Logger provides a way to send different types of log messages to stderr/stdout
 type Logger struct {
 	stderr  *log.Logger
+	warning *log.Logger
 	stdout  *log.Logger
 	toClose []closeable
 }
@@ -39,6 +40,7 @@ func NewLogger(stdout string, stderr string) (logger *Logger, err error) {
 
 	logger = &Logger{
 		stderr:  log.New(stderrWriter, "ERROR ", log.LstdFlags|log.Lshortfile),
+		warning: log.New(stderrWriter, "WARNING ", log.LstdFlags|log.Lshortfile),
 		stdout:  log.New(stdoutWriter, "INFO ", log.LstdFlags|log.Lshortfile),
 		toClose: toClose,
 	}
@@ -55,6 +57,16 @@ func (l *Logger) Infof(format string, v ...interface{}) {
 	l.stdout.Printf(format, v...)
 }
 
+// Warning prints message to stderr
+func (l *Logger) Warning(v ...interface{}) {
+	l.warning.Print(v...)
+}
+
+// Warningf prints message to stderr
+func (l *Logger) Warningf(format string, v ...interface{}) {
+	l.warning.Printf(format, v...)
+}
+
 // Error prints message to stderr
 func (l *Logger) Error(v ...interface{}) {
 	l.stderr.Print(v...)
@@ -19,9 +19,19 @@ const (
 	Command       OpType = "command"
 	Count         OpType = "command.count"
 	FindAndModify OpType = "command.findandmodify"
+	Aggregate     OpType = "command.aggregate"
+	Distinct      OpType = "command.distinct"
+	CreateIndexes OpType = "command.createindexes"
+	DropIndexes   OpType = "command.dropindexes"
+	GeoNear       OpType = "command.geonear"
+	MapReduce     OpType = "command.mapreduce"
+	CollMod       OpType = "command.collmod"
+	Transaction   OpType = "transaction"
 )
 
-// AllOpTypes specifies all supported op types
+// AllOpTypes specifies all supported op types. Command stands for the commands
+// that are passed through verbatim, see OpsExecutor, and Transaction for whole
+// multi-document transactions.
 var AllOpTypes = []OpType{
 	Insert,
 	Update,
@@ -29,6 +39,15 @@ var AllOpTypes = []OpType{
 	Query,
 	Count,
 	FindAndModify,
+	Aggregate,
+	Distinct,
+	CreateIndexes,
+	DropIndexes,
+	GeoNear,
+	MapReduce,
+	CollMod,
+	Command,
+	Transaction,
 }
 
 // Op represents a MongoDB operation that contains enough details to be
@@ -42,10 +61,35 @@ type Op struct {
 	// The details of this op, which may vary for different op types.
 	Content Document
 
-	// TextContent contains an original JSON in a string format describing the
-	// operation as seen in the file that we load the operations from. It's
-	// order to determine the correct $orderby and $hint values, since the
-	// Unmarshalled version of the JSON stored in the Content Document doesn't
-	// Preserve the right order of the keys in the map.
+	// TextContent optionally contains the original JSON describing the
+	// operation as seen in the file that we load the operations from. It isn't
+	// needed to replay the op: the parts of Content whose key order matters,
+	// like $orderby and $hint, are stored as bson.D.
 	TextContent string
+
+	// When the dispatcher meant the op to be sent, following its schedule.
+	// Zero if it has none, e.g. when ops are sent as fast as possible. See
+	// OpStat.ResponseTime.
+	IntendedTime time.Time
+
+	// Position of the op in the file it was read from: its line number in a
+	// JSON file, or the number of its document in a BSON file, from 1.
+	Position int
+
+	// How many times a CyclicOpsReader started over before reading the op,
+	// so that a restart can be told from an op recorded out of order.
+	Cycle int
+
+	// Session and TxnNumber identify the multi-document transaction the op
+	// was recorded in. Session is empty for ops run outside of a transaction.
+	Session   string
+	TxnNumber int64
+
+	// The ops of a Transaction op, in the order they were recorded. See
+	// TransactionOpsReader.
+	Ops []*Op
+
+	// When the recorded transaction of a Transaction op ended, i.e. when the
+	// whole transaction could be known. Zero for other ops.
+	EndTimestamp time.Time
 }
@@ -0,0 +1,95 @@
+package flashback
+
+import (
+	"errors"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
+)
+
+// ErrorCategory tells apart the kinds of errors ops fail with, e.g. duplicate
+// key errors, which are expected when documents are inserted again, from
+// network errors.
+type ErrorCategory string
+
+const (
+	DuplicateKeyError  ErrorCategory = "duplicate_key"
+	TimeoutError       ErrorCategory = "timeout"
+	NetworkError       ErrorCategory = "network"
+	WriteConflictError ErrorCategory = "write_conflict"
+	NotPrimaryError    ErrorCategory = "not_primary"
+	OtherServerError   ErrorCategory = "server"
+	ClientError        ErrorCategory = "client"
+)
+
+// AllErrorCategories lists the error categories, in the order they are
+// reported.
+var AllErrorCategories = []ErrorCategory{
+	DuplicateKeyError,
+	TimeoutError,
+	NetworkError,
+	WriteConflictError,
+	NotPrimaryError,
+	OtherServerError,
+	ClientError,
+}
+
+// Server error codes
+const (
+	writeConflictCode                   = 112
+	primarySteppedDownCode              = 189
+	notWritablePrimaryCode              = 10107
+	interruptedDueToReplStateChangeCode = 11602
+	notPrimaryNoSecondaryOkCode         = 13435
+	notPrimaryOrSecondaryCode           = 13436
+)
+
+var notPrimaryCodes = map[int]bool{
+	primarySteppedDownCode:              true,
+	notWritablePrimaryCode:              true,
+	interruptedDueToReplStateChangeCode: true,
+	notPrimaryNoSecondaryOkCode:         true,
+	notPrimaryOrSecondaryCode:           true,
+}
+
+// ClassifyError gets the category of an error and the server error code it
+// carries, if any (0 otherwise).
+func ClassifyError(err error) (ErrorCategory, int) {
+	code := errorCode(err)
+	switch {
+	case mongo.IsTimeout(err):
+		return TimeoutError, code
+	case mongo.IsDuplicateKeyError(err):
+		return DuplicateKeyError, code
+	case code == writeConflictCode:
+		return WriteConflictError, code
+	case notPrimaryCodes[code]:
+		return NotPrimaryError, code
+	case mongo.IsNetworkError(err) || errors.As(err, &topology.ServerSelectionError{}):
+		return NetworkError, code
+	}
+	var serverError mongo.ServerError
+	if errors.As(err, &serverError) {
+		return OtherServerError, code
+	}
+	return ClientError, code
+}
+
+// Get the server error code of an error. Write errors take precedence over
+// write concern errors.
+func errorCode(err error) int {
+	var commandError mongo.CommandError
+	if errors.As(err, &commandError) {
+		return int(commandError.Code)
+	}
+	var writeException mongo.WriteException
+	if errors.As(err, &writeException) {
+		if len(writeException.WriteErrors) > 0 {
+			return writeException.WriteErrors[0].Code
+		}
+		if writeException.WriteConcernError != nil {
+			return writeException.WriteConcernError.Code
+		}
+	}
+	return 0
+}
@@ -2,11 +2,14 @@ package flashback
 
 import (
 	"fmt"
+	"sync"
 	"time"
 )
 
 func NewBestEffortOpsDispatcher(reader OpsReader, opsSize int, logger *Logger) chan *Op {
-	queue := make([]*Op, opsSize, opsSize)
+	// opsSize is only a bound, and is huge by default, so the queue grows as
+	// the ops are loaded
+	queue := make([]*Op, 0)
 	i := 0
 
 	// preload all the ops to avoid any overhead for fetching ops.
@@ -23,7 +26,7 @@ func NewBestEffortOpsDispatcher(reader OpsReader, opsSize int, logger *Logger) c
 		if op == nil {
 			break
 		}
-		queue[i] = op
+		queue = append(queue, op)
 
 		if i != 0 && i%30000 == 0 {
 			reportStatus()
@@ -44,29 +47,86 @@ func NewBestEffortOpsDispatcher(reader OpsReader, opsSize int, logger *Logger) c
 	return opChannel
 }
 
-func NewByTimeOpsDispatcher(reader OpsReader, opsSize int, logger *Logger, speedup float64) chan *Op {
-	opChannel := make(chan *Op, 5000)
+// LagPolicy tells the by-time dispatcher what to do with the ops it is about
+// to send too late, see NewByTimeOpsDispatcher.
+type LagPolicy string
+
+const (
+	// Send them anyway, the replay just runs behind the recording
+	ContinueOnLag LagPolicy = "continue"
+	// Drop them until the replay catches up with the recording
+	DropOnLag LagPolicy = "drop"
+	// Stop dispatching, so that the replay ends
+	AbortOnLag LagPolicy = "abort"
+)
+
+func ParseLagPolicy(text string) (LagPolicy, error) {
+	switch policy := LagPolicy(text); policy {
+	case ContinueOnLag, DropOnLag, AbortOnLag:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown lag policy: %s", text)
+}
+
+// NewByTimeOpsDispatcher replays ops as far apart as they were recorded,
+// divided by speedup. Transactions are replayed when they ended, since that's
+// when TransactionOpsReader returns them. When the workers can't keep up, the
+// ops are sent as soon as possible, and the lag behind the recorded timeline
+// is recorded in stats. Ops that are more than maxLag late when they are about
+// to be sent are handled according to lagPolicy, unless maxLag is 0.
+func NewByTimeOpsDispatcher(reader OpsReader, opsSize int, logger *Logger, speedup float64,
+	stats *DispatchStats, maxLag time.Duration, lagPolicy LagPolicy) chan *Op {
+	// ops are handed over to a worker directly rather than queued, so that
+	// the time they wait for one counts in the lag
+	opChannel := make(chan *Op)
 	go func() {
 		logger.Info(fmt.Sprintf("Started replaying ops by time with speedup of %f", speedup))
 		now_epoch := time.Unix(0, 0)
 		epoch := time.Unix(0, 0)
+		cycle := 0
+		var previousIntended time.Time
 		for i := 0; i < opsSize && !reader.AllLoaded(); i++ {
 			op := reader.Next()
 			if op == nil {
 				break
 			}
-			if epoch.Unix() == 0 {
-				epoch = op.Timestamp
+			recorded := op.Timestamp
+			if !op.EndTimestamp.IsZero() {
+				recorded = op.EndTimestamp
+			}
+			// when a cyclic reader starts over, its ops are replayed from now
+			// on
+			if epoch.Unix() == 0 || op.Cycle != cycle {
+				epoch = recorded
 				now_epoch = time.Now()
+				cycle = op.Cycle
 			}
 
-			elapsed := op.Timestamp.Sub(epoch)
-			currentElapsed := time.Now().Sub(now_epoch)
-			currentElapsedScaled := time.Duration(float64(currentElapsed/time.Nanosecond) * speedup)
-			if elapsed > currentElapsedScaled {
-				time.Sleep(elapsed - currentElapsedScaled)
+			// the op is due as long after the first one as it was recorded,
+			// divided by speedup. Ops recorded out of order are due right
+			// after the previous op.
+			elapsed := recorded.Sub(epoch)
+			op.IntendedTime = now_epoch.Add(time.Duration(float64(elapsed) / speedup))
+			if op.IntendedTime.Before(previousIntended) {
+				op.IntendedTime = previousIntended
+			}
+			previousIntended = op.IntendedTime
+			if wait := time.Until(op.IntendedTime); wait > 0 {
+				time.Sleep(wait)
+			}
+			lag := time.Since(op.IntendedTime)
+			if maxLag > 0 && lag > maxLag && lagPolicy != ContinueOnLag {
+				if lagPolicy == DropOnLag {
+					stats.drop(lag)
+					continue
+				}
+				logger.Error(fmt.Sprintf(
+					"Aborting the replay: %v behind the recording, more than the %v allowed", lag, maxLag))
+				stats.abort(lag)
+				break
 			}
 			opChannel <- op
+			stats.record(time.Since(op.IntendedTime))
 			if reader.OpsRead()%10000 == 0 {
 				logger.Info("Timestamp for latest op: ", op.Timestamp)
 			}
@@ -76,3 +136,263 @@ func NewByTimeOpsDispatcher(reader OpsReader, opsSize int, logger *Logger, speed
 	}()
 	return opChannel
 }
+
+// Ops sent later than that after the time they were scheduled for are counted
+// as late
+const lateDispatchThreshold = 10 * time.Millisecond
+
+// DispatchStats tells how well a dispatcher keeps up with its schedule. It is
+// safe to use from multiple goroutines.
+type DispatchStats struct {
+	dispatched         int64
+	intervalDispatched int64
+	late               int64
+	intervalLate       int64
+	lag                time.Duration
+	maxLag             time.Duration
+	intervalMaxLag     time.Duration
+	dropped            int64
+	intervalDropped    int64
+	aborted            bool
+	targetRate         float64
+
+	startTime         time.Time
+	intervalStartTime time.Time
+	mutex             *sync.Mutex
+}
+
+// DispatchStatus is a snapshot of DispatchStats. The interval values are
+// the ones since the previous snapshot.
+type DispatchStatus struct {
+	Dispatched         int64
+	IntervalDispatched int64
+	OpsPerSec          float64
+	IntervalOpsPerSec  float64
+
+	// Ops sent more than lateDispatchThreshold after their scheduled time
+	Late         int64
+	IntervalLate int64
+
+	// How far behind its schedule the dispatcher was with the last op, and
+	// at worst
+	Lag            time.Duration
+	MaxLag         time.Duration
+	IntervalMaxLag time.Duration
+
+	// Ops dropped for being too late, and whether dispatching was aborted
+	// for it, see LagPolicy
+	Dropped         int64
+	IntervalDropped int64
+	Aborted         bool
+
+	// The rate the dispatcher is asked to send ops at, in ops/sec, if any
+	TargetOpsPerSec float64
+}
+
+func NewDispatchStats() *DispatchStats {
+	now := time.Now()
+	return &DispatchStats{
+		startTime:         now,
+		intervalStartTime: now,
+		mutex:             &sync.Mutex{},
+	}
+}
+
+// Record an op sent with the given lag behind its schedule
+func (s *DispatchStats) record(lag time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	lag = s.setLag(lag)
+	s.dispatched++
+	s.intervalDispatched++
+	if lag > lateDispatchThreshold {
+		s.late++
+		s.intervalLate++
+	}
+}
+
+// Record an op dropped with the given lag behind its schedule
+func (s *DispatchStats) drop(lag time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.setLag(lag)
+	s.dropped++
+	s.intervalDropped++
+}
+
+// Record that dispatching stopped with the given lag behind its schedule
+func (s *DispatchStats) abort(lag time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.setLag(lag)
+	s.aborted = true
+}
+
+// Must be called with the mutex held. Returns the lag, which is never
+// negative.
+func (s *DispatchStats) setLag(lag time.Duration) time.Duration {
+	if lag < 0 {
+		lag = 0
+	}
+	s.lag = lag
+	if lag > s.maxLag {
+		s.maxLag = lag
+	}
+	if lag > s.intervalMaxLag {
+		s.intervalMaxLag = lag
+	}
+	return lag
+}
+
+func (s *DispatchStats) setTargetRate(rate float64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.targetRate = rate
+}
+
+// TargetRate returns the rate the dispatcher is asked to send ops at, in
+// ops/sec, or 0 if it doesn't follow a rate. See StatsAnalyzer.SetTargetRate.
+func (s *DispatchStats) TargetRate() float64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.targetRate
+}
+
+// GetStatus returns a snapshot of the stats, and starts a new interval.
+func (s *DispatchStats) GetStatus() *DispatchStatus {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	status := &DispatchStatus{
+		Dispatched:         s.dispatched,
+		IntervalDispatched: s.intervalDispatched,
+		OpsPerSec:          float64(s.dispatched) / now.Sub(s.startTime).Seconds(),
+		IntervalOpsPerSec:  float64(s.intervalDispatched) / now.Sub(s.intervalStartTime).Seconds(),
+		Late:               s.late,
+		IntervalLate:       s.intervalLate,
+		Lag:                s.lag,
+		MaxLag:             s.maxLag,
+		IntervalMaxLag:     s.intervalMaxLag,
+		Dropped:            s.dropped,
+		IntervalDropped:    s.intervalDropped,
+		Aborted:            s.aborted,
+		TargetOpsPerSec:    s.targetRate,
+	}
+
+	s.intervalDispatched = 0
+	s.intervalLate = 0
+	s.intervalMaxLag = 0
+	s.intervalDropped = 0
+	s.intervalStartTime = now
+	return status
+}
+
+// NewTargetRateOpsDispatcher sends ops at a fixed rate, whatever their
+// timestamps and however fast they are executed, so that latencies can be
+// measured under a given load. When the workers, or the reader, can't keep
+// up, the ops are sent as soon as possible, and the lag behind the schedule is
+// recorded in stats.
+func NewTargetRateOpsDispatcher(reader OpsReader, opsSize int, logger *Logger, opsPerSec float64,
+	stats *DispatchStats) chan *Op {
+	opChannel := make(chan *Op, 1000)
+	stats.setTargetRate(opsPerSec)
+	go func() {
+		logger.Infof("Started dispatching ops at a target rate of %.2f ops/sec", opsPerSec)
+		start := time.Now()
+		for i := 0; i < opsSize && !reader.AllLoaded(); i++ {
+			op := reader.Next()
+			if op == nil {
+				break
+			}
+
+			// ops are scheduled from the start, so that delays don't add up
+			scheduled := start.Add(time.Duration(float64(i) / opsPerSec * float64(time.Second)))
+			if wait := time.Until(scheduled); wait > 0 {
+				time.Sleep(wait)
+			}
+			op.IntendedTime = scheduled
+			opChannel <- op
+			stats.record(time.Since(scheduled))
+		}
+		logger.Info("Dispatching ended")
+		close(opChannel)
+	}()
+	return opChannel
+}
+
+// The rate of a load profile is checked again at least that often while
+// scheduling the next op, so that a change of rate, or the end of a rate of 0,
+// is followed even when the rate in effect would put the op far later
+const rateCheckInterval = 100 * time.Millisecond
+
+// NewLoadProfileOpsDispatcher sends ops at the rate a load profile gives over
+// time, whatever their timestamps and however fast they are executed. When the
+// workers, or the reader, can't keep up, the ops are sent as soon as possible,
+// and the lag behind the schedule is recorded in stats, along with the target
+// rate in effect. Dispatching ends with the ops or with the profile.
+func NewLoadProfileOpsDispatcher(reader OpsReader, opsSize int, logger *Logger, profile LoadProfile,
+	stats *DispatchStats) chan *Op {
+	opChannel := make(chan *Op, 1000)
+	go func() {
+		logger.Info("Started dispatching ops by load profile")
+		start := time.Now()
+		due := start
+
+		// Move due forward by the time it takes to send the given number of
+		// ops, at the rates of the profile along the way, and tell whether the
+		// profile is still on by then. Each op is due after the previous one
+		// rather than from the start, so that delays don't add up.
+		schedule := func(ops float64) bool {
+			for {
+				rate, ok := profile.Rate(due.Sub(start))
+				if !ok {
+					return false
+				}
+				stats.setTargetRate(rate)
+				if ops <= 0 {
+					return true
+				}
+				step := rateCheckInterval
+				if rate > 0 {
+					if needed := time.Duration(ops / rate * float64(time.Second)); needed < step {
+						step, ops = needed, 0
+					} else {
+						ops -= rate * step.Seconds()
+					}
+				}
+				due = due.Add(step)
+				if ops > 0 {
+					time.Sleep(time.Until(due))
+				}
+			}
+		}
+
+		for i := 0; i < opsSize && !reader.AllLoaded(); i++ {
+			// the first op is due right away
+			ops := 1.0
+			if i == 0 {
+				ops = 0
+			}
+			if !schedule(ops) {
+				break
+			}
+			op := reader.Next()
+			if op == nil {
+				break
+			}
+			if wait := time.Until(due); wait > 0 {
+				time.Sleep(wait)
+			}
+			op.IntendedTime = due
+			opChannel <- op
+			stats.record(time.Since(due))
+		}
+		logger.Info("Dispatching ended")
+		close(opChannel)
+	}()
+	return opChannel
+}
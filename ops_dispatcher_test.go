@@ -0,0 +1,320 @@
+package flashback
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type TestDispatcherSuite struct{}
+
+var _ = Suite(&TestDispatcherSuite{})
+
+// Make a reader of n inserts, recorded a second apart
+func newInsertsReader(c *C, n int) OpsReader {
+	offsets := make([]int, n)
+	for i := range offsets {
+		offsets[i] = i * 1000
+	}
+	return newTimedInsertsReader(c, offsets...)
+}
+
+// Make a reader of inserts, recorded the given number of milliseconds after
+// the same time
+func newTimedInsertsReader(c *C, offsets ...int) OpsReader {
+	var lines []string
+	for i, offset := range offsets {
+		lines = append(lines, fmt.Sprintf(
+			`{ "ts": {"$date": %d}, "ns": "db.coll", "op": "insert", "o": {"i": %d} }`, 1396456709421+offset, i))
+	}
+	err, reader := NewByLineOpsReader(strings.NewReader(strings.Join(lines, "\n")), logger, "")
+	c.Assert(err, IsNil)
+	return reader
+}
+
+func (s *TestDispatcherSuite) TestTargetRate(c *C) {
+	logger, _ = NewLogger("", "")
+	stats := NewDispatchStats()
+
+	// the timestamps of the ops don't matter
+	start := time.Now()
+	opsChan := NewTargetRateOpsDispatcher(newInsertsReader(c, 21), 100, logger, 200, stats)
+	received := 0
+	for range opsChan {
+		received++
+	}
+	elapsed := time.Since(start)
+	c.Assert(received, Equals, 21)
+	c.Assert(elapsed >= 100*time.Millisecond, Equals, true)
+	c.Assert(elapsed < time.Second, Equals, true)
+
+	status := stats.GetStatus()
+	c.Assert(status.Dispatched, Equals, int64(21))
+	c.Assert(status.IntervalDispatched, Equals, int64(21))
+	c.Assert(stats.GetStatus().IntervalDispatched, Equals, int64(0))
+}
+
+func (s *TestDispatcherSuite) TestDispatchStats(c *C) {
+	stats := NewDispatchStats()
+	stats.record(-time.Millisecond)
+	stats.record(50 * time.Millisecond)
+	stats.record(time.Millisecond)
+
+	status := stats.GetStatus()
+	c.Assert(status.Dispatched, Equals, int64(3))
+	c.Assert(status.Late, Equals, int64(1))
+	c.Assert(status.IntervalLate, Equals, int64(1))
+	c.Assert(status.Lag, Equals, time.Millisecond)
+	c.Assert(status.MaxLag, Equals, 50*time.Millisecond)
+
+	stats.record(20 * time.Millisecond)
+	status = stats.GetStatus()
+	c.Assert(status.Late, Equals, int64(2))
+	c.Assert(status.IntervalLate, Equals, int64(1))
+	c.Assert(status.MaxLag, Equals, 50*time.Millisecond)
+	c.Assert(status.IntervalMaxLag, Equals, 20*time.Millisecond)
+}
+
+func (s *TestDispatcherSuite) TestLoadProfiles(c *C) {
+	rate := func(profile LoadProfile, elapsed time.Duration) float64 {
+		rate, ok := profile.Rate(elapsed)
+		c.Assert(ok, Equals, true)
+		return rate
+	}
+
+	ramp, err := ParseLoadProfile("ramp:from=1000,to=3000,over=10m")
+	c.Assert(err, IsNil)
+	c.Assert(ramp, DeepEquals, &RampProfile{From: 1000, To: 3000, Over: 10 * time.Minute})
+	c.Assert(rate(ramp, 0), Equals, 1000.0)
+	c.Assert(rate(ramp, 5*time.Minute), Equals, 2000.0)
+	c.Assert(rate(ramp, time.Hour), Equals, 3000.0)
+
+	steps, err := ParseLoadProfile("steps:from=2000,step=2000,every=5m,max=5000")
+	c.Assert(err, IsNil)
+	c.Assert(rate(steps, 4*time.Minute), Equals, 2000.0)
+	c.Assert(rate(steps, 5*time.Minute), Equals, 4000.0)
+	c.Assert(rate(steps, 12*time.Minute), Equals, 5000.0)
+
+	sine, err := ParseLoadProfile("sine:mean=1000,amplitude=1500,period=4s")
+	c.Assert(err, IsNil)
+	c.Assert(rate(sine, 0), Equals, 1000.0)
+	c.Assert(math.Abs(rate(sine, time.Second)-2500) < 1e-6, Equals, true)
+	c.Assert(rate(sine, 3*time.Second), Equals, 0.0)
+
+	dir := c.MkDir()
+	filename := filepath.Join(dir, "profile.csv")
+	c.Assert(os.WriteFile(filename, []byte("seconds,ops_per_sec\n0,100\n10,200\n\n20,0\n"), 0644), IsNil)
+	csv, err := ParseLoadProfile("csv:" + filename)
+	c.Assert(err, IsNil)
+	c.Assert(rate(csv, 5*time.Second), Equals, 150.0)
+	c.Assert(rate(csv, 15*time.Second), Equals, 100.0)
+	_, ok := csv.Rate(21 * time.Second)
+	c.Assert(ok, Equals, false)
+
+	c.Assert(os.WriteFile(filename, []byte("0,100\n10,200\n5,300\n"), 0644), IsNil)
+	_, err = ParseLoadProfile("csv:" + filename)
+	c.Assert(err, ErrorMatches, ".*:3: points must be sorted by time")
+
+	_, err = ParseLoadProfile("ramp:from=1000,over=10m")
+	c.Assert(err, ErrorMatches, "missing load profile parameter: to")
+	_, err = ParseLoadProfile("ramp:from=1000,to=2000,over=10m,by=2")
+	c.Assert(err, ErrorMatches, "unknown load profile parameter: by")
+	_, err = ParseLoadProfile("steps:from=1000,step=10,every=-1s")
+	c.Assert(err, ErrorMatches, "invalid or missing every: -1s")
+	_, err = ParseLoadProfile("square:from=1")
+	c.Assert(err, ErrorMatches, "unknown load profile: square")
+}
+
+func (s *TestDispatcherSuite) TestLoadProfileDispatcher(c *C) {
+	logger, _ = NewLogger("", "")
+	stats := NewDispatchStats()
+
+	// 10 ops at 100 ops/sec, then 10 at 200 ops/sec, and the profile is over
+	profile := &PointsProfile{Points: []RatePoint{{0, 100}, {95 * time.Millisecond, 100},
+		{100 * time.Millisecond, 200}, {145 * time.Millisecond, 200}}}
+	start := time.Now()
+	opsChan := NewLoadProfileOpsDispatcher(newInsertsReader(c, 100), 100, logger, profile, stats)
+	received := 0
+	var previous time.Time
+	for op := range opsChan {
+		received++
+		// the ops are stamped with the time they are due
+		c.Assert(op.IntendedTime.After(previous), Equals, true)
+		previous = op.IntendedTime
+	}
+	elapsed := time.Since(start)
+	c.Assert(received, Equals, 20)
+	c.Assert(previous.Sub(start) >= 145*time.Millisecond, Equals, true)
+	c.Assert(elapsed >= 140*time.Millisecond, Equals, true)
+	c.Assert(stats.TargetRate(), Equals, 200.0)
+}
+
+func (s *TestDispatcherSuite) TestLoadProfileRateChange(c *C) {
+	logger, _ = NewLogger("", "")
+	stats := NewDispatchStats()
+
+	// the second op would be due in 100s at the starting rate, but the rate
+	// goes up after 200ms, and the ops follow it
+	profile := &StepProfile{From: 0.01, Step: 1000, Every: 200 * time.Millisecond, Max: 1000}
+	start := time.Now()
+	opsChan := NewLoadProfileOpsDispatcher(newInsertsReader(c, 5), 100, logger, profile, stats)
+	received := 0
+	for range opsChan {
+		received++
+	}
+	elapsed := time.Since(start)
+	c.Assert(received, Equals, 5)
+	c.Assert(elapsed >= 200*time.Millisecond, Equals, true)
+	c.Assert(elapsed < time.Second, Equals, true)
+	c.Assert(stats.TargetRate(), Equals, 1000.0)
+}
+
+func (s *TestDispatcherSuite) TestByTimeIntendedTime(c *C) {
+	logger, _ = NewLogger("", "")
+
+	// the ops were recorded a second apart, and are replayed 100x faster
+	start := time.Now()
+	stats := NewDispatchStats()
+	opsChan := NewByTimeOpsDispatcher(newInsertsReader(c, 5), 100, logger, 100, stats, 0, ContinueOnLag)
+	var intended []time.Time
+	for op := range opsChan {
+		intended = append(intended, op.IntendedTime)
+	}
+	c.Assert(intended, HasLen, 5)
+	c.Assert(time.Since(start) < 500*time.Millisecond, Equals, true)
+	c.Assert(intended[0].Sub(start) < 10*time.Millisecond, Equals, true)
+	for i := 1; i < len(intended); i++ {
+		c.Assert(intended[i].Sub(intended[i-1]), Equals, 10*time.Millisecond)
+	}
+	c.Assert(stats.GetStatus().Dispatched, Equals, int64(5))
+
+	replay := func(reader OpsReader) []*Op {
+		var ops []*Op
+		for op := range NewByTimeOpsDispatcher(reader, 100, logger, 100, NewDispatchStats(), 0, ContinueOnLag) {
+			ops = append(ops, op)
+		}
+		return ops
+	}
+
+	// an op recorded out of order is due right after the previous one, and
+	// the schedule goes on
+	ops := replay(newTimedInsertsReader(c, 0, 1000, 500, 2000))
+	c.Assert(ops, HasLen, 4)
+	c.Assert(ops[2].IntendedTime, Equals, ops[1].IntendedTime)
+	c.Assert(ops[3].IntendedTime.Sub(ops[0].IntendedTime), Equals, 20*time.Millisecond)
+
+	// the schedule starts over with a cyclic reader
+	cyclic := NewCyclicOpsReader(func() OpsReader { return newInsertsReader(c, 2) }, logger)
+	ops = replay(&limitedReader{cyclic, 4})
+	c.Assert(ops, HasLen, 4)
+	c.Assert(ops[1].Cycle, Equals, 0)
+	c.Assert(ops[2].Cycle, Equals, 1)
+	c.Assert(ops[2].IntendedTime.Before(ops[1].IntendedTime), Equals, false)
+	c.Assert(ops[3].IntendedTime.Sub(ops[2].IntendedTime), Equals, 10*time.Millisecond)
+}
+
+// A reader that ends after a number of ops, e.g. to stop a cyclic reader
+type limitedReader struct {
+	OpsReader
+	limit int
+}
+
+func (r *limitedReader) Next() *Op {
+	if r.OpsRead() >= r.limit {
+		return nil
+	}
+	return r.OpsReader.Next()
+}
+
+// A reader that takes its time to read each op but the first
+type slowReader struct {
+	OpsReader
+	delay time.Duration
+}
+
+func (r *slowReader) Next() *Op {
+	if r.OpsRead() > 0 {
+		time.Sleep(r.delay)
+	}
+	return r.OpsReader.Next()
+}
+
+func (s *TestDispatcherSuite) TestLagPolicies(c *C) {
+	logger, _ = NewLogger("", "")
+
+	// the ops are due a millisecond apart, and each of them is read 50ms
+	// after the previous one, so that they are sent about 0, 50, 100, 150
+	// and 200ms late
+	replay := func(lagPolicy LagPolicy) (int, *DispatchStatus) {
+		stats := NewDispatchStats()
+		reader := &slowReader{newInsertsReader(c, 5), 50 * time.Millisecond}
+		opsChan := NewByTimeOpsDispatcher(reader, 100, logger, 1000, stats, 75*time.Millisecond, lagPolicy)
+		received := 0
+		for range opsChan {
+			received++
+		}
+		return received, stats.GetStatus()
+	}
+
+	received, status := replay(ContinueOnLag)
+	c.Assert(received, Equals, 5)
+	c.Assert(status.Dropped, Equals, int64(0))
+	c.Assert(status.MaxLag > 150*time.Millisecond, Equals, true)
+
+	received, status = replay(DropOnLag)
+	c.Assert(received, Equals, 2)
+	c.Assert(status.Dispatched, Equals, int64(2))
+	c.Assert(status.Dropped, Equals, int64(3))
+	c.Assert(status.IntervalDropped, Equals, int64(3))
+	c.Assert(status.Aborted, Equals, false)
+
+	received, status = replay(AbortOnLag)
+	c.Assert(received, Equals, 2)
+	c.Assert(status.Dropped, Equals, int64(0))
+	c.Assert(status.Aborted, Equals, true)
+
+	// ops wait for a worker rather than in a queue, so that slow workers
+	// show in the lag
+	stats := NewDispatchStats()
+	reader := newTimedInsertsReader(c, 0, 1, 2, 3)
+	for range NewByTimeOpsDispatcher(reader, 100, logger, 1, stats, 0, ContinueOnLag) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	c.Assert(stats.GetStatus().MaxLag > 100*time.Millisecond, Equals, true)
+
+	// a transaction is due when it ended, which is when it is read, so it
+	// isn't late for having lasted long
+	txnLines := []string{
+		`{"op": "insert", "ns": "db.coll", "command": {"insert": "coll", "documents": [{"a": 1}], "lsid": {"id": "s1"}, "txnNumber": 1, "startTransaction": true, "autocommit": false}, "ts": {"$date": 1396456709000}}`,
+		`{"op": "insert", "ns": "db.coll", "o": {"b": 1}, "ts": {"$date": 1396456709500}}`,
+		`{"op": "insert", "ns": "db.coll", "o": {"b": 2}, "ts": {"$date": 1396456710500}}`,
+		`{"op": "command", "ns": "admin.$cmd", "command": {"commitTransaction": 1, "lsid": {"id": "s1"}, "txnNumber": 1, "autocommit": false}, "ts": {"$date": 1396456711000}}`,
+		`{"op": "insert", "ns": "db.coll", "o": {"b": 3}, "ts": {"$date": 1396456711100}}`,
+	}
+	for _, lagPolicy := range []LagPolicy{DropOnLag, AbortOnLag} {
+		err, lineReader := NewByLineOpsReader(strings.NewReader(strings.Join(txnLines, "\n")), logger, "")
+		c.Assert(err, IsNil)
+		stats = NewDispatchStats()
+		reader := NewTransactionOpsReader(lineReader, logger)
+		var ops []*Op
+		for op := range NewByTimeOpsDispatcher(reader, 100, logger, 10, stats, 50*time.Millisecond, lagPolicy) {
+			ops = append(ops, op)
+		}
+		c.Assert(ops, HasLen, 4)
+		c.Assert(ops[2].Type, Equals, Transaction)
+		c.Assert(ops[2].IntendedTime.Sub(ops[0].IntendedTime), Equals, 150*time.Millisecond)
+		status := stats.GetStatus()
+		c.Assert(status.Dropped, Equals, int64(0))
+		c.Assert(status.Aborted, Equals, false)
+	}
+
+	_, err := ParseLagPolicy("drop")
+	c.Assert(err, IsNil)
+	_, err = ParseLagPolicy("skip")
+	c.Assert(err, ErrorMatches, "unknown lag policy: skip")
+}
@@ -1,21 +1,70 @@
 package flashback
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"gopkg.in/mgo.v2"
 	"strings"
 	"time"
+
+	driverbson "go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/tag"
+	"gopkg.in/mgo.v2/bson"
 )
 
 var (
 	NotSupported = errors.New("op type not supported")
+
+	// Legacy query modifiers, and the find command options they map to
+	queryModifiers = map[string]string{
+		"$comment":     "comment",
+		"$maxScan":     "maxScan",
+		"$maxTimeMS":   "maxTimeMS",
+		"$max":         "max",
+		"$min":         "min",
+		"$returnKey":   "returnKey",
+		"$showDiskLoc": "showRecordId",
+		"$snapshot":    "snapshot",
+	}
+
+	// Fields that drivers and servers add to recorded commands, which must not
+	// be sent back when the command is replayed.
+	commandMetadataFields = map[string]bool{
+		"$db":                true,
+		"$clusterTime":       true,
+		"$readPreference":    true,
+		"$client":            true,
+		"$configServerState": true,
+		"lsid":               true,
+		"txnNumber":          true,
+		"autocommit":         true,
+		"startTransaction":   true,
+		"shardVersion":       true,
+	}
+
+	// Commands replayed by runCommand that are writes or reads, and thus take
+	// the node's write concern, or its read concern and read preference.
+	// mapReduce is either, depending on where its output goes.
+	writeCommands = map[string]bool{
+		"findAndModify": true,
+		"createIndexes": true,
+		"dropIndexes":   true,
+		"collMod":       true,
+	}
+	readCommands = map[string]bool{
+		"distinct": true,
+		"geoNear":  true,
+	}
 )
 
-type execute func(content Document, textContent string, collection *mgo.Collection) error
+type execute func(ctx context.Context, content Document, collection *mongo.Collection) error
 
 type OpsExecutor struct {
-	session   *mgo.Session
+	client    *mongo.Client
 	statsChan chan OpStat
 	logger    *Logger
 
@@ -24,13 +73,30 @@ type OpsExecutor struct {
 	lastResult  interface{}
 	lastLatency time.Duration
 	subExecutes map[OpType]execute
+
+	// see SetConsistency
+	writeConcern       interface{}
+	replayWriteConcern bool
+	readPreference     *readpref.ReadPref
+	readConcern        string
+
+	// Set while the ops of a transaction are replayed, see execTransaction
+	inTransaction bool
+
+	// see SetRetryPolicy
+	retryPolicy RetryPolicy
+
+	// see SetTimeouts. maxTimeMs is the override for the op being replayed.
+	timeouts  Timeouts
+	maxTimeMs int
 }
 
-func NewOpsExecutor(session *mgo.Session, statsChan chan OpStat, logger *Logger) *OpsExecutor {
+func NewOpsExecutor(client *mongo.Client, statsChan chan OpStat, logger *Logger) *OpsExecutor {
 	e := &OpsExecutor{
-		session:   session,
-		statsChan: statsChan,
-		logger:    logger,
+		client:      client,
+		statsChan:   statsChan,
+		logger:      logger,
+		retryPolicy: NewDefaultRetryPolicy(),
 	}
 
 	e.subExecutes = map[OpType]execute{
@@ -39,114 +105,481 @@ func NewOpsExecutor(session *mgo.Session, statsChan chan OpStat, logger *Logger)
 		Update:        e.execUpdate,
 		Remove:        e.execRemove,
 		Count:         e.execCount,
-		FindAndModify: e.execFindAndModify,
+		FindAndModify: e.execCommand("findAndModify"),
+		Aggregate:     e.execAggregate,
+		Distinct:      e.execCommand("distinct"),
+		CreateIndexes: e.execCommand("createIndexes"),
+		DropIndexes:   e.execCommand("dropIndexes"),
+		GeoNear:       e.execCommand("geoNear"),
+		MapReduce:     e.execCommand("mapReduce"),
+		CollMod:       e.execCommand("collMod"),
+		Command:       e.execPassthrough,
 	}
 	return e
 }
 
-// Given a JSON of the op (as a raw string) and a key (e.g. $hint or $orderby),
-// extract the arguments, transforming { organization: 1, date_created: -1 }
-// into a list ["organization", "-date_created"].
-func getArgs(textContent string, key string) []string {
-
-	// Initialize a list of arguments
-	args := make([]string, 0)
-
-	// Find the key we're looking for in the string
-	start := strings.Index(textContent, "\""+key+"\"")
-	textContent = textContent[start+len(key)+2:]
-
-	// Parse the string assuming proper format (it's safe to do so here
-	// because the string we use has already been parsed to JSON).
-	// States of the parser:
-	// 0 - looking for key
-	// 1 - in the key (looking for its end)
-	// 2 - looking for direction of the index (after found, resets state to 0)
-	state := 0
-	buffer := ""
-	for _, c := range textContent {
-		if state == 0 && c == '}' {
-			break
-		} else if state == 0 && c == '"' {
-			state = 1
-		} else if state == 1 {
-			if c == '"' {
-				args = append(args, buffer)
-				buffer = ""
-				state = 2
-			} else {
-				buffer += string(c)
-			}
-		} else if state == 2 && c == '-' {
-			args[len(args)-1] = "-" + args[len(args)-1]
-		} else if state == 2 && c == '1' {
-			state = 0
+// SetConsistency sets the write concern, read preference and read concern the
+// ops are replayed with. The concerns recorded with the ops are dropped
+// (except the write concern, if asked to), since they may refer to the
+// cluster they were recorded on, e.g. with afterClusterTime.
+func (e *OpsExecutor) SetConsistency(consistency *Consistency) error {
+	readPreference, err := consistency.readPreference()
+	if err != nil {
+		return err
+	}
+	e.writeConcern = consistency.writeConcern()
+	e.replayWriteConcern = consistency.ReplayWriteConcern
+	e.readPreference = readPreference
+	e.readConcern = consistency.ReadConcern
+	return nil
+}
+
+// SetRetryPolicy sets how failed ops are retried. By default network errors
+// are retried once.
+func (e *OpsExecutor) SetRetryPolicy(policy RetryPolicy) {
+	e.retryPolicy = policy
+}
+
+// SetTimeouts sets the maxTimeMS overrides and the client side deadline of
+// the ops.
+func (e *OpsExecutor) SetTimeouts(timeouts *Timeouts) {
+	e.timeouts = *timeouts
+}
+
+// Set the maxTimeMS of a command, if it is overridden for the op being
+// replayed. Otherwise the recorded value, if any, is kept.
+func (e *OpsExecutor) withMaxTime(cmd bson.D) bson.D {
+	if e.maxTimeMs <= 0 {
+		return cmd
+	}
+	for i, elem := range cmd {
+		if elem.Name == "maxTimeMS" {
+			cmd[i].Value = e.maxTimeMs
+			return cmd
 		}
 	}
-	return args
+	return append(cmd, bson.DocElem{Name: "maxTimeMS", Value: e.maxTimeMs})
 }
 
-func (e *OpsExecutor) execQuery(content Document, textContent string, coll *mgo.Collection) error {
-	var query *mgo.Query
+// Get the write concern to replay a write with, given the one it was recorded
+// with, if any.
+func (e *OpsExecutor) writeConcernFor(recorded interface{}) interface{} {
+	if e.replayWriteConcern && recorded != nil {
+		return recorded
+	}
+	return e.writeConcern
+}
+
+// Add the write concern to a write command. Writes in a transaction take the
+// write concern of the transaction instead.
+func (e *OpsExecutor) withWriteConcern(cmd bson.D, recorded interface{}) bson.D {
+	if e.inTransaction {
+		return cmd
+	}
+	if writeConcern := e.writeConcernFor(recorded); writeConcern != nil {
+		cmd = append(cmd, bson.DocElem{Name: "writeConcern", Value: writeConcern})
+	}
+	return cmd
+}
+
+// Add the read concern to a read command, and get the options to run it with
+// the read preference. The node's read preference takes precedence over the
+// recorded one, if any. Reads in a transaction take the read concern of the
+// transaction instead, and go to the primary.
+func (e *OpsExecutor) withReadConcern(cmd bson.D, recordedReadPreference interface{}) (bson.D, *options.RunCmdOptions) {
+	if e.inTransaction {
+		return cmd, options.RunCmd()
+	}
+	if e.readConcern != "" {
+		cmd = append(cmd, bson.DocElem{Name: "readConcern", Value: bson.D{{Name: "level", Value: e.readConcern}}})
+	}
+	opts := options.RunCmd()
+	if e.readPreference != nil {
+		opts.SetReadPreference(e.readPreference)
+	} else if recorded, ok := recordedReadPreference.(map[string]interface{}); ok {
+		if rp, err := readPreference(recorded); err != nil {
+			e.logger.Error("could not set read preference: ", err)
+		} else if rp != nil {
+			opts.SetReadPreference(rp)
+		}
+	}
+	return cmd, opts
+}
+
+// Commands are built with the same BSON package the ops are decoded with, and
+// marshalled as is, so that recorded values keep their exact types. The
+// driver only carries the raw command to the server.
+func marshalCommand(cmd bson.D) (driverbson.Raw, error) {
+	data, err := bson.Marshal(cmd)
+	return driverbson.Raw(data), err
+}
+
+// Run a command against a database and decode its reply into result.
+func runCommandOn(ctx context.Context, db *mongo.Database, cmd bson.D, result interface{},
+	opts ...*options.RunCmdOptions) error {
+	raw, err := marshalCommand(cmd)
+	if err != nil {
+		return err
+	}
+	reply, err := db.RunCommand(ctx, raw, opts...).DecodeBytes()
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(reply, result)
+}
+
+// Run a command that returns a cursor and fetch all of its batches, as a real
+// client would.
+func (e *OpsExecutor) runCursorCommand(ctx context.Context, cmd bson.D, coll *mongo.Collection,
+	opts ...*options.RunCmdOptions) error {
 	result := []Document{}
+	e.lastResult = &result
+	raw, err := marshalCommand(cmd)
+	if err != nil {
+		return err
+	}
+	cursor, err := coll.Database().RunCommandCursor(ctx, raw, opts...)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		doc := Document{}
+		if err := bson.Unmarshal(cursor.Current, &doc); err != nil {
+			return err
+		}
+		result = append(result, doc)
+	}
+	return cursor.Err()
+}
 
-	// cast the query to a map of string keys to interfaces
-	q, ok := content["query"].(map[string]interface{})
+// Read preference modes, as recorded in $readPreference
+var readPreferenceModes = map[string]readpref.Mode{
+	"primary":            readpref.PrimaryMode,
+	"primaryPreferred":   readpref.PrimaryPreferredMode,
+	"secondary":          readpref.SecondaryMode,
+	"secondaryPreferred": readpref.SecondaryPreferredMode,
+	"nearest":            readpref.NearestMode,
+}
 
-	// If the query contains $hint or $orderby, we need to make sure that these
-	// are applied via Query.Hint and Query.Sort with the correct order
-	if ok && q["$query"] != nil {
-		query = coll.Find(q["$query"])
-		if q["$hint"] != nil {
-			query.Hint(getArgs(textContent, "$hint")...)
+// Build the read preference recorded in $readPreference. Returns nil if the
+// recorded mode is unknown.
+func readPreference(recorded map[string]interface{}) (*readpref.ReadPref, error) {
+	mode, _ := recorded["mode"].(string)
+	m, ok := readPreferenceModes[mode]
+	if !ok {
+		return nil, nil
+	}
+	tags, _ := recorded["tags"].([]interface{})
+	tagSets := make([]tag.Set, 0, len(tags))
+	for _, t := range tags {
+		recordedSet, ok := t.(map[string]interface{})
+		if !ok {
+			continue
 		}
-		if q["$orderby"] != nil {
-			query.Sort(getArgs(textContent, "$orderby")...)
+		tagSet := tag.Set{}
+		for name, value := range recordedSet {
+			if value, ok := value.(string); ok {
+				tagSet = append(tagSet, tag.Tag{Name: name, Value: value})
+			}
 		}
+		tagSets = append(tagSets, tagSet)
+	}
+	if len(tagSets) > 0 {
+		return readpref.New(m, readpref.WithTagSets(tagSets...))
+	}
+	return readpref.New(m)
+}
+
+func (e *OpsExecutor) execQuery(ctx context.Context, content Document, coll *mongo.Collection) error {
+	// Queries are replayed as find commands which, unlike mgo's Query, support
+	// all the modifiers that can be recorded.
+	filter := content["query"]
+	q, ok := content["query"].(map[string]interface{})
+	if ok && q["$query"] != nil {
+		filter = q["$query"]
 	} else {
-		query = coll.Find(content["query"])
+		q = nil
+	}
+	if filter == nil {
+		filter = bson.M{}
+	}
+
+	cmd := bson.D{
+		{Name: "find", Value: coll.Name()},
+		{Name: "filter", Value: filter},
+	}
+	if q["$orderby"] != nil {
+		cmd = append(cmd, bson.DocElem{Name: "sort", Value: q["$orderby"]})
+	}
+	if q["$hint"] != nil {
+		cmd = append(cmd, bson.DocElem{Name: "hint", Value: q["$hint"]})
+	}
+	for modifier, option := range queryModifiers {
+		if q[modifier] != nil {
+			cmd = append(cmd, bson.DocElem{Name: option, Value: q[modifier]})
+		}
+	}
+	if content["fields"] != nil {
+		cmd = append(cmd, bson.DocElem{Name: "projection", Value: content["fields"]})
 	}
 	if content["ntoreturn"] != nil {
 		if ntoreturn, err := safeGetInt(content["ntoreturn"]); err != nil {
 			e.logger.Error("could not set ntoreturn: ", err)
-		} else {
-			query.Limit(ntoreturn)
+		} else if ntoreturn < 0 {
+			// a negative ntoreturn asks for a single batch
+			cmd = append(cmd, bson.DocElem{Name: "limit", Value: -ntoreturn})
+			cmd = append(cmd, bson.DocElem{Name: "singleBatch", Value: true})
+		} else if ntoreturn > 0 {
+			cmd = append(cmd, bson.DocElem{Name: "limit", Value: ntoreturn})
 		}
 	}
 	if content["ntoskip"] != nil {
 		if ntoskip, err := safeGetInt(content["ntoskip"]); err != nil {
 			e.logger.Error("could not set ntoskip: ", err)
-		} else {
-			query.Skip(ntoskip)
+		} else if ntoskip > 0 {
+			cmd = append(cmd, bson.DocElem{Name: "skip", Value: ntoskip})
 		}
 	}
-	err := query.All(&result)
+	if content["batchSize"] != nil {
+		cmd = append(cmd, bson.DocElem{Name: "batchSize", Value: content["batchSize"]})
+	}
+
+	cmd, opts := e.withReadConcern(e.withMaxTime(cmd), q["$readPreference"])
+	return e.runCursorCommand(ctx, cmd, coll, opts)
+}
+
+func (e *OpsExecutor) execInsert(ctx context.Context, content Document, coll *mongo.Collection) error {
+	// Insert commands recorded by newer servers may carry several documents
+	docs, ok := content["o"].([]interface{})
+	if !ok {
+		docs = []interface{}{content["o"]}
+	}
+	return e.runWriteCommand(ctx, e.withWriteConcern(bson.D{
+		{Name: "insert", Value: coll.Name()},
+		{Name: "documents", Value: docs},
+	}, content["writeConcern"]), coll)
+}
+
+// The result of an insert, update or delete command.
+type writeResult struct {
+	N           int
+	NModified   int `bson:"nModified"`
+	Upserted    []bson.M
+	WriteErrors []struct {
+		Index  int
+		Code   int
+		ErrMsg string `bson:"errmsg"`
+	} `bson:"writeErrors"`
+	WriteConcernError *struct {
+		Code   int
+		ErrMsg string `bson:"errmsg"`
+	} `bson:"writeConcernError"`
+}
+
+// Run a write command. Write errors are reported by the server in the reply
+// rather than as a command failure, so they are turned into a
+// mongo.WriteException, the same as the driver does for InsertOne and friends.
+func (e *OpsExecutor) runWriteCommand(ctx context.Context, cmd bson.D, coll *mongo.Collection) error {
+	result := writeResult{}
 	e.lastResult = &result
+	if err := runCommandOn(ctx, coll.Database(), cmd, &result); err != nil {
+		return err
+	}
+	if len(result.WriteErrors) == 0 && result.WriteConcernError == nil {
+		return nil
+	}
+	exception := mongo.WriteException{}
+	for _, writeError := range result.WriteErrors {
+		exception.WriteErrors = append(exception.WriteErrors, mongo.WriteError{
+			Index:   writeError.Index,
+			Code:    writeError.Code,
+			Message: writeError.ErrMsg,
+		})
+	}
+	if result.WriteConcernError != nil {
+		exception.WriteConcernError = &mongo.WriteConcernError{
+			Code:    result.WriteConcernError.Code,
+			Message: result.WriteConcernError.ErrMsg,
+		}
+	}
+	return exception
+}
+
+func (e *OpsExecutor) execUpdate(ctx context.Context, content Document, coll *mongo.Collection) error {
+	query := content["query"]
+	if query == nil {
+		query = bson.M{}
+	}
+	multi, _ := content["multi"].(bool)
+	upsert, _ := content["upsert"].(bool)
+	update := bson.M{"q": query, "u": content["updateobj"], "multi": multi, "upsert": upsert}
+	return e.runWriteCommand(ctx, e.withWriteConcern(bson.D{
+		{Name: "update", Value: coll.Name()},
+		{Name: "updates", Value: []bson.M{update}},
+	}, content["writeConcern"]), coll)
+}
+
+func (e *OpsExecutor) execRemove(ctx context.Context, content Document, coll *mongo.Collection) error {
+	query := content["query"]
+	if query == nil {
+		query = bson.M{}
+	}
+	limit := 0
+	if justOne, _ := content["justOne"].(bool); justOne {
+		limit = 1
+	}
+	return e.runWriteCommand(ctx, e.withWriteConcern(bson.D{
+		{Name: "delete", Value: coll.Name()},
+		{Name: "deletes", Value: []bson.M{{"q": query, "limit": limit}}},
+	}, content["writeConcern"]), coll)
+}
+
+func (e *OpsExecutor) execCount(ctx context.Context, content Document, coll *mongo.Collection) error {
+	query := content["query"]
+	if query == nil {
+		query = bson.D{}
+	}
+	cmd := bson.D{
+		{Name: "count", Value: coll.Name()},
+		{Name: "query", Value: query},
+	}
+	for _, name := range []string{"limit", "skip", "maxTimeMS", "hint"} {
+		if content[name] != nil {
+			cmd = append(cmd, bson.DocElem{Name: name, Value: content[name]})
+		}
+	}
+
+	cmd, opts := e.withReadConcern(e.withMaxTime(cmd), nil)
+	result := struct{ N int }{}
+	err := runCommandOn(ctx, coll.Database(), cmd, &result, opts)
+	e.lastResult = result.N
 	return err
 }
 
-func (e *OpsExecutor) execInsert(content Document, textContent string, coll *mgo.Collection) error {
-	return coll.Insert(content["o"])
+func (e *OpsExecutor) execAggregate(ctx context.Context, content Document, coll *mongo.Collection) error {
+	// The command is built by hand, rather than with Collection.Aggregate, so
+	// that it is replayed with the recorded values.
+	cmd := bson.D{
+		{Name: "aggregate", Value: coll.Name()},
+		{Name: "pipeline", Value: content["pipeline"]},
+	}
+	cursor := bson.M{}
+	if recorded, ok := content["cursor"].(map[string]interface{}); ok && recorded["batchSize"] != nil {
+		cursor["batchSize"] = recorded["batchSize"]
+	}
+	cmd = append(cmd, bson.DocElem{Name: "cursor", Value: cursor})
+	if content["allowDiskUse"] != nil {
+		cmd = append(cmd, bson.DocElem{Name: "allowDiskUse", Value: content["allowDiskUse"]})
+	}
+	for _, name := range []string{"hint", "collation", "maxTimeMS"} {
+		if content[name] != nil {
+			cmd = append(cmd, bson.DocElem{Name: name, Value: content[name]})
+		}
+	}
+
+	cmd, opts := e.withReadConcern(e.withMaxTime(cmd), nil)
+	return e.runCursorCommand(ctx, cmd, coll, opts)
+}
+
+// Run a recorded command against the collection. The command name goes first,
+// as the server requires, followed by the recorded arguments.
+func (e *OpsExecutor) runCommand(ctx context.Context, name string, content Document, coll *mongo.Collection) error {
+	isWrite, isRead := writeCommands[name], readCommands[name]
+	if name == "mapReduce" {
+		isWrite = !isInlineOutput(content["out"])
+		isRead = !isWrite
+	}
+	cmd := bson.D{{Name: name, Value: coll.Name()}}
+	for key, value := range content {
+		if strings.EqualFold(key, name) || commandMetadataFields[key] {
+			continue
+		}
+		if (isWrite || isRead || e.inTransaction) && (key == "writeConcern" || key == "readConcern") {
+			continue
+		}
+		cmd = append(cmd, bson.DocElem{Name: key, Value: value})
+	}
+
+	cmd = e.withMaxTime(cmd)
+	opts := options.RunCmd()
+	if isWrite {
+		cmd = e.withWriteConcern(cmd, content["writeConcern"])
+	} else if isRead {
+		cmd, opts = e.withReadConcern(cmd, nil)
+	}
+	result := bson.M{}
+	e.lastResult = &result
+	return runCommandOn(ctx, coll.Database(), cmd, &result, opts)
+}
+
+// A mapReduce only writes when its results go to a collection rather than
+// being returned inline, i.e. when out isn't {inline: 1}.
+func isInlineOutput(out interface{}) bool {
+	spec, ok := asMap(out)
+	if !ok {
+		return false
+	}
+	inline, err := safeGetInt(spec["inline"])
+	return err == nil && inline == 1
 }
 
-func (e *OpsExecutor) execUpdate(content Document, textContent string, coll *mgo.Collection) error {
-	return coll.Update(content["query"], content["updateobj"])
+// Create an execute function that replays the named command as it was
+// recorded.
+func (e *OpsExecutor) execCommand(name string) execute {
+	return func(ctx context.Context, content Document, coll *mongo.Collection) error {
+		return e.runCommand(ctx, name, content, coll)
+	}
 }
 
-func (e *OpsExecutor) execRemove(content Document, textContent string, coll *mgo.Collection) error {
-	return coll.Remove(content["query"])
+// Replay a command that CanonicalizeOp doesn't know about exactly as it was
+// recorded, against the op's database.
+func (e *OpsExecutor) execPassthrough(ctx context.Context, content Document, coll *mongo.Collection) error {
+	cmd := orderedCommand(content["command"])
+	if len(cmd) == 0 {
+		return NotSupported
+	}
+
+	ordered := make(bson.D, 0, len(cmd))
+	for _, elem := range cmd {
+		if commandMetadataFields[elem.Name] {
+			continue
+		}
+		if e.inTransaction && (elem.Name == "writeConcern" || elem.Name == "readConcern") {
+			continue
+		}
+		ordered = append(ordered, elem)
+	}
+	result := bson.M{}
+	e.lastResult = &result
+	return runCommandOn(ctx, coll.Database(), ordered, &result)
 }
 
-func (e *OpsExecutor) execCount(content Document, textContent string, coll *mgo.Collection) error {
-	_, err := coll.Count()
-	return err
+// CommandName returns the name of the command recorded in a Command op, or an
+// empty string if it can't be determined.
+func CommandName(op *Op) string {
+	cmd := orderedCommand(op.Content["command"])
+	if len(cmd) == 0 {
+		return ""
+	}
+	return cmd[0].Name
 }
 
-func (e *OpsExecutor) execFindAndModify(content Document, textContent string, coll *mgo.Collection) error {
-	result := Document{}
-	change := mgo.Change{Update: content["update"].(map[string]interface{})}
-	_, err := coll.Find(content["query"]).Apply(change, result)
-	return err
+// Get a recorded command with its name, i.e. its first key, first. Readers
+// decode commands as bson.D to keep that order; a command decoded as a map
+// can only be used if it has a single key.
+func orderedCommand(cmd interface{}) bson.D {
+	switch c := cmd.(type) {
+	case bson.D:
+		return c
+	case map[string]interface{}:
+		if len(c) == 1 {
+			for name, value := range c {
+				return bson.D{{Name: name, Value: value}}
+			}
+		}
+	}
+	return nil
 }
 
 // We only support handful op types. This function helps us to process supported
@@ -155,21 +588,60 @@ func (e *OpsExecutor) execFindAndModify(content Document, textContent string, co
 // We do not canonicalize the ops in OpsReader because we hope ops reader to do
 // its job honestly and the consumer of these ops decide how to further process
 // the original ops.
+//
+// Transactions are canonicalized op by op. If any of their ops can't be,
+// nil is returned as for a single op, since replaying only some of the ops
+// of a transaction would change what it does; the ops that can are still
+// canonicalized in place, and the others are left as they were recorded.
 func CanonicalizeOp(op *Op) *Op {
+	if op.Type == Transaction {
+		canonical := true
+		for i, txnOp := range op.Ops {
+			if canonicalOp := CanonicalizeOp(txnOp); canonicalOp != nil {
+				op.Ops[i] = canonicalOp
+			} else {
+				canonical = false
+			}
+		}
+		if !canonical {
+			return nil
+		}
+		return op
+	}
 	if op.Type != Command {
 		return op
 	}
 
-	cmd := op.Content["command"].(map[string]interface{})
+	cmd, ok := asMap(op.Content["command"])
+	if !ok {
+		return nil
+	}
+
+	// find commands are replayed the same way as legacy queries
+	if collName, ok := cmd["find"].(string); ok {
+		op.Type = Query
+		op.Collection = collName
+		op.Content = findToQuery(cmd)
+		return op
+	}
 
-	for _, name := range []string{"findandmodify", "count"} {
-		collName, exist := cmd[name]
+	names := []string{"findandmodify", "count", "aggregate", "distinct", "createindexes",
+		"dropindexes", "geonear", "mapreduce", "collmod"}
+	for _, name := range names {
+		value, exist := lookupCommand(cmd, name)
 		if !exist {
 			continue
 		}
 
+		// e.g. {aggregate: 1} runs against the database rather than a
+		// collection, which we can't replay
+		collName, ok := value.(string)
+		if !ok {
+			return nil
+		}
+
 		op.Type = OpType("command." + name)
-		op.Collection = collName.(string)
+		op.Collection = collName
 		op.Content = cmd
 
 		return op
@@ -178,61 +650,177 @@ func CanonicalizeOp(op *Op) *Op {
 	return nil
 }
 
-func retryOnSocketFailure(block func() error, session *mgo.Session, logger *Logger) error {
-	err := block()
-	if err == nil {
-		return nil
+// Convert a find command into the content of a legacy query op, i.e.
+// {query: {$query, $orderby, $hint, ...modifiers}, fields, ntoreturn, ntoskip,
+// batchSize}.
+func findToQuery(cmd map[string]interface{}) Document {
+	filter := cmd["filter"]
+	if filter == nil {
+		filter = map[string]interface{}{}
 	}
-
-	switch err.(type) {
-	case *mgo.QueryError, *mgo.LastError:
-		return err
+	query := map[string]interface{}{"$query": filter}
+	if cmd["sort"] != nil {
+		query["$orderby"] = cmd["sort"]
 	}
-
-	switch err {
-	case mgo.ErrNotFound, NotSupported:
-		return err
+	if cmd["hint"] != nil {
+		query["$hint"] = cmd["hint"]
+	}
+	if cmd["$readPreference"] != nil {
+		query["$readPreference"] = cmd["$readPreference"]
+	}
+	for modifier, option := range queryModifiers {
+		if cmd[option] != nil {
+			query[modifier] = cmd[option]
+		}
 	}
 
-	// Otherwise it's probably a socket error so we refresh the connection,
-	// and try again
-	session.Refresh()
-	logger.Error("retrying mongo query after error: ", err)
-	return block()
+	content := Document{
+		"query":     query,
+		"fields":    cmd["projection"],
+		"ntoskip":   cmd["skip"],
+		"batchSize": cmd["batchSize"],
+	}
+	if cmd["limit"] != nil {
+		// a negative ntoreturn asks for a single batch, just like singleBatch
+		if limit, err := safeGetInt(cmd["limit"]); err == nil {
+			if singleBatch, _ := cmd["singleBatch"].(bool); singleBatch {
+				limit = -limit
+			}
+			content["ntoreturn"] = limit
+		}
+	}
+	return content
 }
 
 func (e *OpsExecutor) Execute(op *Op) error {
 	startOp := time.Now()
 
-	block := func() error {
-		content := op.Content
-		textContent := op.TextContent
-		coll := e.session.DB(op.Database).C(op.Collection)
-		return e.subExecutes[op.Type](content, textContent, coll)
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if e.timeouts.Deadline > 0 {
+		ctx, cancel = context.WithTimeout(ctx, e.timeouts.Deadline)
+	}
+	defer cancel()
+
+	e.lastResult = nil
+	var err error
+	aborted := false
+	retries := 0
+	if op.Type == Transaction {
+		// A transaction can't be picked up where it failed, so it isn't
+		// retried
+		var committed bool
+		committed, err = e.execTransaction(ctx, op)
+		aborted = !committed
+	} else {
+		e.maxTimeMs = e.timeouts.maxTimeMs(op.Type)
+		block := func() error {
+			content := op.Content
+			coll := e.client.Database(op.Database).Collection(op.Collection)
+			return e.subExecutes[op.Type](ctx, content, coll)
+		}
+		retries, err = retry(ctx, e.retryPolicy, block, e.logger)
 	}
-	err := retryOnSocketFailure(block, e.session, e.logger)
 
-	latencyOp := time.Now().Sub(startOp)
+	endOp := time.Now()
+	latencyOp := endOp.Sub(startOp)
 	e.lastLatency = latencyOp
+	responseTime := latencyOp
+	if !op.IntendedTime.IsZero() {
+		responseTime = endOp.Sub(op.IntendedTime)
+	}
+	e.sendStat(op.Type, latencyOp, responseTime, err, aborted, retries)
+
+	return err
+}
+
+// Report an op. Timeouts, whether they come from maxTimeMS, the op's deadline
+// or the socket timeout, are told apart from other errors.
+func (e *OpsExecutor) sendStat(opType OpType, latency time.Duration, responseTime time.Duration, err error,
+	aborted bool, retries int) {
+	if e.statsChan == nil {
+		return
+	}
+	stat := OpStat{OpType: opType, Latency: latency, ResponseTime: responseTime, Aborted: aborted,
+		Retries: retries}
+	if err != nil {
+		stat.ErrorCategory, stat.ErrorCode = ClassifyError(err)
+		stat.ErrorMessage = err.Error()
+		stat.Timeout = stat.ErrorCategory == TimeoutError
+		stat.OpError = !stat.Timeout
+	}
+	e.statsChan <- stat
+}
 
-	if e.statsChan != nil {
-		if err == nil {
-			e.statsChan <- OpStat{op.Type, latencyOp, false}
-		} else {
-			// error condition
-			e.statsChan <- OpStat{op.Type, latencyOp, true}
+// Get the options of a transaction: the node's concerns, or the write concern
+// its commit was recorded with if asked to. Transactions always read from the
+// primary.
+func (e *OpsExecutor) transactionOptions(op *Op) *options.TransactionOptions {
+	opts := options.Transaction()
+	if writeConcern := e.writeConcernFor(op.Content["writeConcern"]); writeConcern != nil {
+		opts.SetWriteConcern(driverWriteConcern(writeConcern))
+	}
+	if e.readConcern != "" {
+		opts.SetReadConcern(&readconcern.ReadConcern{Level: e.readConcern})
+	}
+	return opts
+}
+
+// Replay the ops of a transaction in a session, then commit or abort it the
+// way it was recorded. Only the transaction is reported, so that its ops
+// aren't counted twice. Returns whether the transaction committed.
+func (e *OpsExecutor) execTransaction(ctx context.Context, op *Op) (bool, error) {
+	session, err := e.client.StartSession()
+	if err != nil {
+		return false, err
+	}
+	// the transaction is ended even if the op's deadline has passed
+	defer session.EndSession(context.Background())
+	if err := session.StartTransaction(e.transactionOptions(op)); err != nil {
+		return false, err
+	}
+
+	e.inTransaction = true
+	defer func() { e.inTransaction = false }()
+	sessionCtx := mongo.NewSessionContext(ctx, session)
+	for _, txnOp := range op.Ops {
+		e.maxTimeMs = e.timeouts.maxTimeMs(txnOp.Type)
+		err := NotSupported
+		if execute, ok := e.subExecutes[txnOp.Type]; ok {
+			coll := e.client.Database(txnOp.Database).Collection(txnOp.Collection)
+			err = execute(sessionCtx, txnOp.Content, coll)
+		}
+		if err != nil {
+			session.AbortTransaction(context.Background())
+			return false, err
 		}
 	}
 
-	return err
+	if op.Content["commit"] != true {
+		return false, session.AbortTransaction(ctx)
+	}
+	err = session.CommitTransaction(ctx)
+	return err == nil, err
 }
 
 func (e *OpsExecutor) LastLatency() time.Duration {
 	return e.lastLatency
 }
 
+// Close does nothing: the client is shared by the executors of a node, and
+// disconnected by its backend.
+func (e *OpsExecutor) Close() {
+}
+
+// LastResult returns the result of the last op, as decoded from the server's
+// reply, or nil if it didn't get one. See ResultVerifier.
+func (e *OpsExecutor) LastResult() interface{} {
+	return e.lastResult
+}
+
 func safeGetInt(i interface{}) (int, error) {
 	switch i.(type) {
+	case int:
+		return i.(int), nil
 	case int32:
 		return int(i.(int32)), nil
 	case int64:
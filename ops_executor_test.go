@@ -1,11 +1,18 @@
 package flashback
 
 import (
+	"context"
 	"fmt"
+	"strings"
 	"testing"
+	"time"
 
+	driverbson "go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
 	. "gopkg.in/check.v1"
-	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
 )
 
 // Hook up gocheck into the "go test" runner.
@@ -17,17 +24,23 @@ type TestExecutorSuite struct{}
 
 var _ = Suite(&TestExecutorSuite{})
 
+// Connect to the local test server and start from an empty database.
+func connectForTest(c *C, dbName string) (*mongo.Client, *mongo.Database) {
+	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI("mongodb://localhost"))
+	c.Assert(err, IsNil)
+	c.Assert(client, NotNil)
+	db := client.Database(dbName)
+	err = db.Drop(context.Background())
+	c.Assert(err, IsNil)
+	return client, db
+}
+
 func (s *TestExecutorSuite) TestExecution(c *C) {
 	test_db := "test_db_for_executor"
 	test_collection := "c1"
 
-	session, err := mgo.Dial("localhost")
-	c.Assert(err, IsNil)
-	c.Assert(session, NotNil)
-	defer session.Close()
-
-	err = session.DB(test_db).DropDatabase()
-	c.Assert(err, IsNil)
+	client, db := connectForTest(c, test_db)
+	defer client.Disconnect(context.Background())
 
 	// insertion
 	insertCmd := fmt.Sprintf(`{"ns": "%s.%s", "ts": {"$date": 1396456709427}, `+
@@ -40,12 +53,13 @@ func (s *TestExecutorSuite) TestExecution(c *C) {
 	op := CanonicalizeOp(makeOp(cmd, make([]string, 0)))
 	logger, err := NewLogger("", "")
 	c.Assert(err, IsNil)
-	exec := NewOpsExecutor(session, nil, logger)
+	exec := NewOpsExecutor(client, nil, logger)
 	err = exec.Execute(op)
 	c.Assert(err, IsNil)
-	coll := session.DB(test_db).C(test_collection)
-	count, err := coll.Count()
-	c.Assert(count, Equals, 1)
+	coll := db.Collection(test_collection)
+	count, err := coll.CountDocuments(context.Background(), bson.M{})
+	c.Assert(err, IsNil)
+	c.Assert(count, Equals, int64(1))
 
 	// Find
 	findCmd := fmt.Sprintf(`{"ntoskip": 0, "ts": {"$date": 1396456709472}, `+
@@ -96,6 +110,56 @@ func (s *TestExecutorSuite) TestExecution(c *C) {
 	c.Assert((*findResult)[0]["logType"].(string), Equals, "foobar")
 	findResult = nil
 
+	// aggregate
+	aggCmd := fmt.Sprintf(
+		`{"ts": {"$date": 1396456709472}, `+
+			`"ns": "%s.$cmd", "command": {"aggregate": "%s", `+
+			`"pipeline": [{"$match": {"logType": "foobar"}}, {"$project": {"logType": 1}}], `+
+			`"cursor": {"batchSize": 1}, "allowDiskUse": true}, "op": "command"}`, test_db, test_collection)
+	cmd, err = parseJson(aggCmd)
+	c.Assert(err, IsNil)
+	aggOp := CanonicalizeOp(makeOp(cmd, make([]string, 0)))
+	c.Assert(aggOp.Type, Equals, Aggregate)
+	err = exec.Execute(aggOp)
+	c.Assert(err, IsNil)
+	findResult = exec.lastResult.(*[]Document)
+	c.Assert(len(*findResult), Equals, 1)
+	c.Assert((*findResult)[0]["logType"].(string), Equals, "foobar")
+	findResult = nil
+
+	// distinct
+	distinctCmd := fmt.Sprintf(
+		`{"ts": {"$date": 1396456709472}, `+
+			`"ns": "%s.$cmd", "command": {"distinct": "%s", "key": "logType", "query": {}}, `+
+			`"op": "command"}`, test_db, test_collection)
+	cmd, err = parseJson(distinctCmd)
+	c.Assert(err, IsNil)
+	distinctOp := CanonicalizeOp(makeOp(cmd, make([]string, 0)))
+	c.Assert(distinctOp.Type, Equals, Distinct)
+	err = exec.Execute(distinctOp)
+	c.Assert(err, IsNil)
+	distinctResult := exec.lastResult.(*bson.M)
+	c.Assert((*distinctResult)["values"], DeepEquals, []interface{}{"foobar"})
+
+	// createIndexes, with a compound key whose order must be kept
+	createIndexesCmd := fmt.Sprintf(
+		`{"ts": {"$date": 1396456709472}, `+
+			`"ns": "%s.$cmd", "command": {"createIndexes": "%s", "indexes": `+
+			`[{"key": {"logType": 1, "timestamp": -1}, "name": "logType_1_timestamp_-1"}]}, `+
+			`"op": "command"}`, test_db, test_collection)
+	cmd, err = parseJson(createIndexesCmd)
+	c.Assert(err, IsNil)
+	err = exec.Execute(CanonicalizeOp(makeOp(cmd, make([]string, 0))))
+	c.Assert(err, IsNil)
+	indexes, err := coll.Indexes().ListSpecifications(context.Background())
+	c.Assert(err, IsNil)
+	c.Assert(len(indexes), Equals, 2)
+	keys, err := indexes[1].KeysDocument.Elements()
+	c.Assert(err, IsNil)
+	c.Assert(len(keys), Equals, 2)
+	c.Assert(keys[0].Key(), Equals, "logType")
+	c.Assert(keys[1].Key(), Equals, "timestamp")
+
 	// Remove
 	removeCmd := fmt.Sprintf(
 		`{"query": {"_id": {"$oid": "533c3d03c23fffd217678ee8"}}, `+
@@ -112,6 +176,272 @@ func (s *TestExecutorSuite) TestExecution(c *C) {
 	c.Assert(len(*findResult), Equals, 0)
 }
 
+func (s *TestExecutorSuite) TestCount(c *C) {
+	test_db := "test_db_for_executor"
+	test_collection := "c1"
+
+	client, db := connectForTest(c, test_db)
+	defer client.Disconnect(context.Background())
+	coll := db.Collection(test_collection)
+	for i := 0; i < 10; i++ {
+		_, err := coll.InsertOne(context.Background(), bson.M{"n": i, "even": i%2 == 0})
+		c.Assert(err, IsNil)
+	}
+	_, err := coll.Indexes().CreateOne(context.Background(),
+		mongo.IndexModel{Keys: driverbson.D{{Key: "even", Value: 1}}})
+	c.Assert(err, IsNil)
+
+	logger, err := NewLogger("", "")
+	c.Assert(err, IsNil)
+	exec := NewOpsExecutor(client, nil, logger)
+
+	count := func(command string) int {
+		countCmd := fmt.Sprintf(
+			`{"ts": {"$date": 1396456709472}, "ns": "%s.$cmd", `+
+				`"command": {"count": "%s", %s}, "op": "command"}`,
+			test_db, test_collection, command)
+		cmd, err := parseJson(countCmd)
+		c.Assert(err, IsNil)
+		op := CanonicalizeOp(makeOp(cmd, make([]string, 0)))
+		c.Assert(op.Type, Equals, Count)
+		err = exec.Execute(op)
+		c.Assert(err, IsNil)
+		return exec.lastResult.(int)
+	}
+
+	c.Assert(count(`"query": {}`), Equals, 10)
+	c.Assert(count(`"query": {"even": true}`), Equals, 5)
+	c.Assert(count(`"query": {"even": true}, "skip": 1, "limit": 3`), Equals, 3)
+	c.Assert(count(`"query": {"even": true}, "hint": {"even": 1}, "maxTimeMS": 10000`), Equals, 5)
+}
+
+func (s *TestExecutorSuite) TestFindAndModify(c *C) {
+	test_db := "test_db_for_executor"
+	test_collection := "jobs"
+
+	client, db := connectForTest(c, test_db)
+	defer client.Disconnect(context.Background())
+	coll := db.Collection(test_collection)
+	for i := 0; i < 5; i++ {
+		_, err := coll.InsertOne(context.Background(), bson.M{"_id": i, "priority": i % 3, "state": "new"})
+		c.Assert(err, IsNil)
+	}
+
+	logger, err := NewLogger("", "")
+	c.Assert(err, IsNil)
+	exec := NewOpsExecutor(client, nil, logger)
+
+	findAndModify := func(command string) bson.M {
+		famCmd := fmt.Sprintf(
+			`{"ts": {"$date": 1396456709472}, "ns": "%s.$cmd", `+
+				`"command": {"findandmodify": "%s", %s}, "op": "command"}`,
+			test_db, test_collection, command)
+		cmd, err := parseJson(famCmd)
+		c.Assert(err, IsNil)
+		op := CanonicalizeOp(makeOp(cmd, make([]string, 0)))
+		c.Assert(op.Type, Equals, FindAndModify)
+		err = exec.Execute(op)
+		c.Assert(err, IsNil)
+		value, _ := (*exec.lastResult.(*bson.M))["value"].(bson.M)
+		return value
+	}
+
+	// sorted, returning the new document with a projection
+	value := findAndModify(`"query": {"state": "new"}, "sort": {"priority": -1, "_id": 1}, ` +
+		`"update": {"$set": {"state": "running"}}, "new": true, "fields": {"state": 1}`)
+	c.Assert(value, DeepEquals, bson.M{"_id": 2, "state": "running"})
+
+	// remove only
+	value = findAndModify(`"query": {"state": "new"}, "sort": {"priority": -1, "_id": 1}, "remove": true`)
+	c.Assert(value["_id"], Equals, 1)
+	count, err := coll.CountDocuments(context.Background(), bson.M{})
+	c.Assert(err, IsNil)
+	c.Assert(count, Equals, int64(4))
+
+	// upsert
+	value = findAndModify(`"query": {"_id": 10}, "update": {"$set": {"state": "new"}}, ` +
+		`"upsert": true, "new": true`)
+	c.Assert(value["_id"], Equals, 10)
+	count, err = coll.CountDocuments(context.Background(), bson.M{})
+	c.Assert(err, IsNil)
+	c.Assert(count, Equals, int64(5))
+}
+
+func (s *TestExecutorSuite) TestMultiWrites(c *C) {
+	test_db := "test_db_for_executor"
+	test_collection := "c1"
+
+	client, db := connectForTest(c, test_db)
+	defer client.Disconnect(context.Background())
+	coll := db.Collection(test_collection)
+	for i := 0; i < 10; i++ {
+		_, err := coll.InsertOne(context.Background(), bson.M{"n": i, "even": i%2 == 0})
+		c.Assert(err, IsNil)
+	}
+
+	logger, err := NewLogger("", "")
+	c.Assert(err, IsNil)
+	exec := NewOpsExecutor(client, nil, logger)
+
+	execute := func(op string) {
+		cmd, err := parseJson(fmt.Sprintf(op, test_db, test_collection))
+		c.Assert(err, IsNil)
+		err = exec.Execute(CanonicalizeOp(makeOp(cmd, make([]string, 0))))
+		c.Assert(err, IsNil)
+	}
+	count := func(query bson.M) int64 {
+		n, err := coll.CountDocuments(context.Background(), query)
+		c.Assert(err, IsNil)
+		return n
+	}
+
+	// multi update
+	execute(`{"ts": {"$date": 1396456709472}, "ns": "%s.%s", "op": "update", ` +
+		`"command": {"q": {"even": true}, "u": {"$set": {"touched": true}}, "multi": true, "upsert": false}}`)
+	c.Assert(count(bson.M{"touched": true}), Equals, int64(5))
+
+	// upsert
+	execute(`{"ts": {"$date": 1396456709472}, "ns": "%s.%s", "op": "update", ` +
+		`"command": {"q": {"n": 100}, "u": {"$set": {"even": true}}, "multi": false, "upsert": true}}`)
+	c.Assert(count(bson.M{"n": 100}), Equals, int64(1))
+
+	// single remove
+	execute(`{"ts": {"$date": 1396456709472}, "ns": "%s.%s", "op": "remove", ` +
+		`"command": {"q": {"even": false}, "limit": 1}}`)
+	c.Assert(count(bson.M{"even": false}), Equals, int64(4))
+
+	// multi remove
+	execute(`{"ts": {"$date": 1396456709472}, "ns": "%s.%s", "op": "remove", ` +
+		`"command": {"q": {"even": true}, "limit": 0}}`)
+	c.Assert(count(bson.M{"even": true}), Equals, int64(0))
+}
+
+func (s *TestExecutorSuite) TestTransactions(c *C) {
+	test_db := "test_db_for_executor"
+	test_collection := "c1"
+
+	client, db := connectForTest(c, test_db)
+	defer client.Disconnect(context.Background())
+	hello := bson.M{}
+	c.Assert(runCommandOn(context.Background(), db, bson.D{{Name: "isMaster", Value: 1}}, &hello), IsNil)
+	if hello["setName"] == nil {
+		c.Skip("transactions need a replica set")
+	}
+	coll := db.Collection(test_collection)
+	_, err := coll.InsertOne(context.Background(), bson.M{"n": 0})
+	c.Assert(err, IsNil)
+
+	logger, err := NewLogger("", "")
+	c.Assert(err, IsNil)
+	statsChan := make(chan OpStat, 10)
+	exec := NewOpsExecutor(client, statsChan, logger)
+
+	transaction := func(commit bool, ops ...string) *Op {
+		txn := &Op{Database: test_db, Collection: test_collection, Type: Transaction,
+			Content: Document{"commit": commit}, Session: "s1", TxnNumber: 1}
+		for _, op := range ops {
+			cmd, err := parseJson(fmt.Sprintf(op, test_db, test_collection))
+			c.Assert(err, IsNil)
+			txn.Ops = append(txn.Ops, makeOp(cmd, make([]string, 0)))
+		}
+		return CanonicalizeOp(txn)
+	}
+	count := func() int64 {
+		n, err := coll.CountDocuments(context.Background(), bson.M{})
+		c.Assert(err, IsNil)
+		return n
+	}
+	insert := `{"ts": {"$date": 1396456709472}, "ns": "%s.%s", "op": "insert", "o": {"n": 1}}`
+	find := `{"ts": {"$date": 1396456709472}, "ns": "%s.%s", "op": "query", ` +
+		`"command": {"find": "c1", "filter": {"n": 1}}}`
+
+	// aborted transactions leave nothing behind
+	c.Assert(exec.Execute(transaction(false, insert, find)), IsNil)
+	c.Assert(count(), Equals, int64(1))
+	stat := <-statsChan
+	c.Assert(stat.OpType, Equals, Transaction)
+	c.Assert(stat.Aborted, Equals, true)
+	c.Assert(stat.OpError, Equals, false)
+
+	c.Assert(exec.Execute(transaction(true, insert, insert)), IsNil)
+	c.Assert(count(), Equals, int64(3))
+	stat = <-statsChan
+	c.Assert(stat.Aborted, Equals, false)
+}
+
+func (s *TestExecutorSuite) TestQueryModifiers(c *C) {
+	test_db := "test_db_for_executor"
+	test_collection := "c1"
+
+	client, db := connectForTest(c, test_db)
+	defer client.Disconnect(context.Background())
+	coll := db.Collection(test_collection)
+	for i := 0; i < 10; i++ {
+		_, err := coll.InsertOne(context.Background(), bson.M{"n": i, "payload": "xxxxxxxx"})
+		c.Assert(err, IsNil)
+	}
+	_, err := coll.Indexes().CreateOne(context.Background(),
+		mongo.IndexModel{Keys: driverbson.D{{Key: "n", Value: 1}}})
+	c.Assert(err, IsNil)
+
+	logger, err := NewLogger("", "")
+	c.Assert(err, IsNil)
+	exec := NewOpsExecutor(client, nil, logger)
+
+	// $min/$max bound the index scan, and the projection drops the payload
+	findCmd := fmt.Sprintf(`{"ntoskip": 0, "ntoreturn": 0, "ts": {"$date": 1396456709472}, `+
+		`"query": {"$query": {}, "$orderby": {"n": 1}, "$hint": {"n": 1}, "$min": {"n": 2}, `+
+		`"$max": {"n": 5}, "$comment": "replayed"}, "returnFieldSelector": {"_id": 0, "n": 1}, `+
+		`"ns": "%s.%s", "op": "query"}`, test_db, test_collection)
+	cmd, err := parseJson(findCmd)
+	c.Assert(err, IsNil)
+	err = exec.Execute(CanonicalizeOp(makeOp(cmd, make([]string, 0))))
+	c.Assert(err, IsNil)
+
+	findResult := exec.lastResult.(*[]Document)
+	c.Assert(len(*findResult), Equals, 3)
+	for i, doc := range *findResult {
+		c.Assert(len(doc), Equals, 1)
+		n, err := safeGetInt(doc["n"])
+		c.Assert(err, IsNil)
+		c.Assert(n, Equals, i+2)
+	}
+}
+
+func (s *TestExecutorSuite) TestCommandName(c *C) {
+	logger, err := NewLogger("", "")
+	c.Assert(err, IsNil)
+
+	testJsonString :=
+		`{"ns": "admin.$cmd", "command": {"ping": 1}, "ts": {"$date": 1396456709421}, "op": "command"}
+		 {"ns": "db.$cmd", "command": {"renameCollection": "db.a", "to": "db.b", "dropTarget": false}, "ts": {"$date": 1396456709422}, "op": "command"}
+		 {"ns": "db.$cmd", "command": {"dbStats": 1, "scale": 1024}, "ts": {"$date": 1396456709423}, "op": "command"}`
+	err, loader := NewByLineOpsReader(strings.NewReader(testJsonString), logger, "")
+	c.Assert(err, IsNil)
+
+	names := []string{}
+	for op := loader.Next(); op != nil; op = loader.Next() {
+		c.Assert(CanonicalizeOp(op), IsNil)
+		names = append(names, CommandName(op))
+	}
+	c.Assert(names, DeepEquals, []string{"ping", "renameCollection", "dbStats"})
+
+	// Commands decoded as maps can only be named if they have a single key
+	op := &Op{Type: Command, Content: Document{"command": map[string]interface{}{"dbStats": 1, "scale": 1024}}}
+	c.Assert(CommandName(op), Equals, "")
+
+	// A transaction can't be canonicalized if one of its commands can't, but
+	// its other ops are all the same
+	find := &Op{Type: Command, Collection: "$cmd",
+		Content: Document{"command": bson.D{{Name: "find", Value: "coll"}}}}
+	ping := &Op{Type: Command, Content: Document{"command": bson.D{{Name: "ping", Value: 1}}}}
+	txn := &Op{Type: Transaction, Ops: []*Op{find, ping}}
+	c.Assert(CanonicalizeOp(txn), IsNil)
+	c.Assert(txn.Ops[0].Type, Equals, Query)
+	c.Assert(txn.Ops[1].Type, Equals, Command)
+	c.Assert(CanonicalizeOp(&Op{Type: Transaction, Ops: []*Op{find}}), NotNil)
+}
+
 func (s *TestExecutorSuite) TestSafeGetInt(c *C) {
 	val, err := safeGetInt(int32(11))
 	c.Assert(err, IsNil)
@@ -128,3 +458,360 @@ func (s *TestExecutorSuite) TestSafeGetInt(c *C) {
 	val, err = safeGetInt("a")
 	c.Assert(err, NotNil)
 }
+
+func (s *TestExecutorSuite) TestConsistency(c *C) {
+	logger, _ = NewLogger("", "")
+
+	// nothing set: server defaults, primary reads
+	c.Assert((&Consistency{}).writeConcern(), IsNil)
+	rp, err := (&Consistency{}).readPreference()
+	c.Assert(err, IsNil)
+	c.Assert(rp, IsNil)
+
+	c.Assert((&Consistency{W: "2", J: true, WTimeoutMs: 500}).writeConcern(), DeepEquals,
+		bson.D{{Name: "w", Value: 2}, {Name: "j", Value: true}, {Name: "wtimeout", Value: 500}})
+	c.Assert((&Consistency{W: "majority"}).writeConcern(), DeepEquals, bson.D{{Name: "w", Value: "majority"}})
+
+	tagSets, err := parseTagSets("dc:east, rack:1;dc:west")
+	c.Assert(err, IsNil)
+	c.Assert(len(tagSets), Equals, 2)
+	c.Assert(tagSets[0][1].Name, Equals, "rack")
+	c.Assert(tagSets[0][1].Value, Equals, "1")
+	_, err = parseTagSets("dc")
+	c.Assert(err, NotNil)
+
+	rp, err = (&Consistency{ReadPreference: "secondaryPreferred", ReadPreferenceTags: "dc:east"}).readPreference()
+	c.Assert(err, IsNil)
+	c.Assert(rp.Mode(), Equals, readpref.SecondaryPreferredMode)
+	c.Assert(len(rp.TagSets()), Equals, 1)
+	c.Assert((&Consistency{ReadPreference: "anywhere"}).Validate(), NotNil)
+	c.Assert((&Consistency{ReadPreferenceTags: "dc:east"}).Validate(), NotNil)
+
+	// the recorded write concern is only replayed when asked to
+	exec := NewOpsExecutor(nil, nil, logger)
+	c.Assert(exec.SetConsistency(&Consistency{W: "1"}), IsNil)
+	recorded := map[string]interface{}{"w": "majority"}
+	c.Assert(exec.withWriteConcern(bson.D{}, recorded), DeepEquals, bson.D{{Name: "writeConcern", Value: bson.D{{Name: "w", Value: 1}}}})
+	c.Assert(exec.SetConsistency(&Consistency{W: "1", ReplayWriteConcern: true}), IsNil)
+	c.Assert(exec.withWriteConcern(bson.D{}, recorded), DeepEquals, bson.D{{Name: "writeConcern", Value: recorded}})
+	c.Assert(exec.withWriteConcern(bson.D{}, nil), DeepEquals, bson.D{{Name: "writeConcern", Value: bson.D{{Name: "w", Value: 1}}}})
+
+	// mapReduce is a write unless it returns its results inline
+	c.Assert(isInlineOutput(map[string]interface{}{"inline": 1}), Equals, true)
+	c.Assert(isInlineOutput(bson.D{{Name: "inline", Value: float64(1)}}), Equals, true)
+	c.Assert(isInlineOutput(map[string]interface{}{"replace": "results"}), Equals, false)
+	c.Assert(isInlineOutput("results"), Equals, false)
+
+	// the node's read preference wins over the recorded one
+	recordedReadPreference := map[string]interface{}{"mode": "secondary"}
+	c.Assert(exec.SetConsistency(&Consistency{ReadConcern: "majority"}), IsNil)
+	cmd, opts := exec.withReadConcern(bson.D{}, recordedReadPreference)
+	c.Assert(cmd, DeepEquals, bson.D{{Name: "readConcern", Value: bson.D{{Name: "level", Value: "majority"}}}})
+	c.Assert(opts.ReadPreference.Mode(), Equals, readpref.SecondaryMode)
+	c.Assert(exec.SetConsistency(&Consistency{ReadPreference: "nearest"}), IsNil)
+	cmd, opts = exec.withReadConcern(bson.D{}, recordedReadPreference)
+	c.Assert(len(cmd), Equals, 0)
+	c.Assert(opts.ReadPreference.Mode(), Equals, readpref.NearestMode)
+}
+
+func (s *TestExecutorSuite) TestTimeouts(c *C) {
+	logger, _ = NewLogger("", "")
+
+	byType, err := ParseMaxTimeMsByType("query:1000, command.aggregate:5000")
+	c.Assert(err, IsNil)
+	c.Assert(byType, DeepEquals, map[OpType]int{Query: 1000, Aggregate: 5000})
+	_, err = ParseMaxTimeMsByType("query")
+	c.Assert(err, NotNil)
+	_, err = ParseMaxTimeMsByType("find:1000")
+	c.Assert(err, NotNil)
+	_, err = ParseMaxTimeMsByType("query:soon")
+	c.Assert(err, NotNil)
+
+	timeouts := &Timeouts{MaxTimeMs: 200, MaxTimeMsByType: byType}
+	c.Assert(timeouts.maxTimeMs(Query), Equals, 1000)
+	c.Assert(timeouts.maxTimeMs(Count), Equals, 200)
+	c.Assert((&Timeouts{}).maxTimeMs(Query), Equals, 0)
+
+	// the recorded maxTimeMS is kept unless it is overridden
+	statsChan := make(chan OpStat, 10)
+	exec := NewOpsExecutor(nil, statsChan, logger)
+	exec.SetTimeouts(timeouts)
+	recorded := bson.D{{Name: "count", Value: "c1"}, {Name: "maxTimeMS", Value: 10}}
+	c.Assert(exec.withMaxTime(recorded), DeepEquals, recorded)
+	exec.maxTimeMs = timeouts.maxTimeMs(Count)
+	c.Assert(exec.withMaxTime(bson.D{{Name: "count", Value: "c1"}, {Name: "maxTimeMS", Value: 10}}), DeepEquals,
+		bson.D{{Name: "count", Value: "c1"}, {Name: "maxTimeMS", Value: 200}})
+	c.Assert(exec.withMaxTime(bson.D{{Name: "count", Value: "c1"}}), DeepEquals,
+		bson.D{{Name: "count", Value: "c1"}, {Name: "maxTimeMS", Value: 200}})
+
+	// timeouts are reported apart from errors
+	exec.sendStat(Query, time.Second, time.Second, context.DeadlineExceeded, false, 0)
+	exec.sendStat(Query, time.Second, time.Second, mongo.CommandError{Code: 50, Name: "MaxTimeMSExpired"}, false, 0)
+	exec.sendStat(Query, time.Second, time.Second, mongo.CommandError{Code: 11000}, false, 0)
+	for _, timeout := range []bool{true, true, false} {
+		stat := <-statsChan
+		c.Assert(stat.Timeout, Equals, timeout)
+		c.Assert(stat.OpError, Equals, !timeout)
+	}
+}
+
+func (s *TestExecutorSuite) TestClassifyError(c *C) {
+	writeError := func(code int) error {
+		return mongo.WriteException{WriteErrors: mongo.WriteErrors{{Code: code, Message: "write error"}}}
+	}
+	cases := []struct {
+		err      error
+		category ErrorCategory
+		code     int
+	}{
+		{writeError(11000), DuplicateKeyError, 11000},
+		{mongo.CommandError{Code: 11000}, DuplicateKeyError, 11000},
+		{mongo.CommandError{Code: 50, Name: "MaxTimeMSExpired"}, TimeoutError, 50},
+		{context.DeadlineExceeded, TimeoutError, 0},
+		{mongo.CommandError{Code: 112, Name: "WriteConflict"}, WriteConflictError, 112},
+		{mongo.CommandError{Code: 10107, Name: "NotWritablePrimary"}, NotPrimaryError, 10107},
+		{writeError(10107), NotPrimaryError, 10107},
+		{mongo.CommandError{Labels: []string{"NetworkError"}}, NetworkError, 0},
+		{mongo.CommandError{Code: 26, Name: "NamespaceNotFound"}, OtherServerError, 26},
+		{fmt.Errorf("replaying op: %w", writeError(2)), OtherServerError, 2},
+		{NotSupported, ClientError, 0},
+	}
+	for _, t := range cases {
+		category, code := ClassifyError(t.err)
+		c.Assert(category, Equals, t.category, Commentf("%v", t.err))
+		c.Assert(code, Equals, t.code, Commentf("%v", t.err))
+	}
+}
+
+func (s *TestExecutorSuite) TestRetryPolicy(c *C) {
+	logger, _ = NewLogger("", "")
+	networkError := mongo.CommandError{Labels: []string{"NetworkError"}}
+	serverError := mongo.CommandError{Code: 2, Name: "BadValue"}
+
+	// by default, network errors are retried once
+	policy := NewDefaultRetryPolicy()
+	ok, backoff := policy.Retry(1, networkError)
+	c.Assert(ok, Equals, true)
+	c.Assert(backoff, Equals, time.Duration(0))
+	ok, _ = policy.Retry(2, networkError)
+	c.Assert(ok, Equals, false)
+	ok, _ = policy.Retry(1, serverError)
+	c.Assert(ok, Equals, false)
+
+	// exponential backoff, capped
+	policy = &BackoffRetryPolicy{MaxAttempts: 10, InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff: time.Second, RetryableErrors: map[ErrorCategory]bool{NetworkError: true}}
+	for attempt, expected := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		ok, backoff = policy.Retry(attempt+1, networkError)
+		c.Assert(ok, Equals, true)
+		c.Assert(backoff, Equals, expected*time.Millisecond)
+	}
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		_, backoff = policy.Retry(2, networkError)
+		c.Assert(backoff >= 100*time.Millisecond && backoff <= 200*time.Millisecond, Equals, true)
+	}
+
+	categories, err := ParseErrorCategories("network, not_primary")
+	c.Assert(err, IsNil)
+	c.Assert(categories, DeepEquals, map[ErrorCategory]bool{NetworkError: true, NotPrimaryError: true})
+	_, err = ParseErrorCategories("network,socket")
+	c.Assert(err, NotNil)
+
+	// ops are tried again until they succeed or the policy gives up
+	attempts := 0
+	failTwice := func() error {
+		attempts++
+		if attempts <= 2 {
+			return networkError
+		}
+		return nil
+	}
+	policy = &BackoffRetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond,
+		RetryableErrors: map[ErrorCategory]bool{NetworkError: true}}
+	retries, err := retry(context.Background(), policy, failTwice, logger)
+	c.Assert(err, IsNil)
+	c.Assert(retries, Equals, 2)
+
+	attempts = 0
+	policy.MaxAttempts = 2
+	retries, err = retry(context.Background(), policy, failTwice, logger)
+	c.Assert(err, DeepEquals, networkError)
+	c.Assert(retries, Equals, 1)
+
+	// or the op's deadline passes
+	attempts = 0
+	policy = &BackoffRetryPolicy{MaxAttempts: 3, InitialBackoff: time.Minute,
+		RetryableErrors: map[ErrorCategory]bool{NetworkError: true}}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	retries, err = retry(ctx, policy, failTwice, logger)
+	c.Assert(err, DeepEquals, networkError)
+	c.Assert(retries, Equals, 0)
+}
+
+func (s *TestExecutorSuite) TestResultVerifier(c *C) {
+	logger, _ = NewLogger("", "")
+	verifier := NewResultVerifier("challenger", logger)
+
+	docs := func(values ...int) *[]Document {
+		result := []Document{}
+		for _, value := range values {
+			result = append(result, Document{"n": value, "sub": bson.M{"b": 1, "a": int64(value)}})
+		}
+		return &result
+	}
+	query := &Op{Type: Query, Content: Document{"query": map[string]interface{}{"$query": bson.M{}}}}
+	sorted := &Op{Type: Query, Content: Document{"query": map[string]interface{}{
+		"$query": bson.M{}, "$orderby": bson.D{{Name: "n", Value: 1}}}}}
+	aggregate := &Op{Type: Aggregate, Content: Document{"pipeline": []interface{}{
+		bson.D{{Name: "$sort", Value: bson.D{{Name: "n", Value: 1}}}}}}}
+
+	// the order only matters if the documents are sorted
+	c.Assert(verifier.Verify(query, docs(1, 2), nil, docs(2, 1), nil), Equals, true)
+	c.Assert(verifier.Verify(sorted, docs(1, 2), nil, docs(2, 1), nil), Equals, false)
+	c.Assert(verifier.Verify(aggregate, docs(1, 2), nil, docs(2, 1), nil), Equals, false)
+	c.Assert(verifier.Verify(query, docs(1, 2), nil, docs(1), nil), Equals, false)
+
+	// numbers compare equal whatever their type
+	c.Assert(verifier.Verify(query, &[]Document{{"n": int32(1)}}, nil, &[]Document{{"n": 1.0}}, nil), Equals, true)
+
+	count := &Op{Type: Count}
+	c.Assert(verifier.Verify(count, 3, nil, 3, nil), Equals, true)
+	c.Assert(verifier.Verify(count, 3, nil, 4, nil), Equals, false)
+
+	distinct := &Op{Type: Distinct}
+	c.Assert(verifier.Verify(distinct, &bson.M{"values": []interface{}{"a", "b"}, "ok": 1.0}, nil,
+		&bson.M{"values": []interface{}{"b", "a"}, "ok": 1}, nil), Equals, true)
+	findAndModify := &Op{Type: FindAndModify}
+	c.Assert(verifier.Verify(findAndModify, &bson.M{"value": bson.M{"n": 1}}, nil,
+		&bson.M{"value": nil}, nil), Equals, false)
+
+	// the ids of upserted documents aren't compared
+	update := &Op{Type: Update}
+	c.Assert(verifier.Verify(update, &writeResult{N: 1, Upserted: []bson.M{{"_id": 1}}}, nil,
+		&writeResult{N: 1, Upserted: []bson.M{{"_id": 2}}}, nil), Equals, true)
+	c.Assert(verifier.Verify(update, &writeResult{N: 2, NModified: 2}, nil,
+		&writeResult{N: 2, NModified: 1}, nil), Equals, false)
+
+	// failures match failures only
+	c.Assert(verifier.Verify(count, nil, NotSupported, nil, mongo.CommandError{Code: 2}), Equals, true)
+	c.Assert(verifier.Verify(count, nil, NotSupported, 3, nil), Equals, false)
+
+	// other ops aren't verified
+	c.Assert(verifier.Verify(&Op{Type: CreateIndexes}, &bson.M{"ok": 1}, nil, nil, NotSupported), Equals, true)
+
+	verified, mismatches := verifier.Counts()
+	c.Assert(verified, DeepEquals, map[OpType]int64{Query: 4, Aggregate: 1, Count: 4, Distinct: 1,
+		FindAndModify: 1, Update: 2})
+	c.Assert(mismatches, DeepEquals, map[OpType]int64{Query: 2, Aggregate: 1, Count: 2, FindAndModify: 1, Update: 1})
+}
+
+func (s *TestExecutorSuite) TestDryRun(c *C) {
+	exec := NewDryRunExecutor()
+
+	c.Assert(exec.Execute(&Op{Type: Insert, Content: Document{"o": bson.M{"a": 1}}, Position: 1}), IsNil)
+	c.Assert(exec.Execute(&Op{Type: Query, Content: Document{"query": bson.M{}}, Position: 2}), IsNil)
+	c.Assert(exec.Execute(&Op{Type: Insert, Content: Document{"o": bson.M{"a": 2}}, Position: 3}), IsNil)
+	c.Assert(exec.Execute(&Op{Type: Aggregate, Content: Document{"pipeline": "$match"}, Position: 4}),
+		Equals, NotSupported)
+	// a transaction is rejected as a whole
+	txn := &Op{Type: Transaction, Position: 5, Ops: []*Op{
+		{Type: Insert, Content: Document{"o": bson.M{"a": 3}}},
+		{Type: Command, Content: Document{"command": map[string]interface{}{"a": 1, "b": 2}}},
+	}}
+	c.Assert(exec.Execute(txn), Equals, NotSupported)
+
+	exec.Report(OpIssue{Position: 6, OpType: "getmore", Reason: "unsupported op type"})
+	exec.Report(OpIssue{Position: 7, OpType: "getmore", Reason: "unsupported op type"})
+	exec.Report(OpIssue{Position: 8, Rejected: true, Reason: "invalid JSON"})
+
+	c.Assert(exec.Executed(), DeepEquals, map[OpType]int64{Insert: 2, Query: 1})
+	c.Assert(exec.Issues(), DeepEquals, []IssueCount{
+		{Rejected: true, Reason: "invalid JSON", Count: 1, Positions: []int{8}},
+		{OpType: Aggregate, Rejected: true, Reason: "aggregate without a pipeline", Count: 1, Positions: []int{4}},
+		{OpType: "getmore", Reason: "unsupported op type", Count: 2, Positions: []int{6, 7}},
+		{OpType: Transaction, Rejected: true, Reason: "in transaction: command whose name can't be told", Count: 1,
+			Positions: []int{5}},
+	})
+}
+
+// An executor that records the ops it is given, instead of replaying them
+type recordingExecutor struct {
+	ops    []*Op
+	closed bool
+}
+
+func (e *recordingExecutor) Execute(op *Op) error {
+	e.ops = append(e.ops, op)
+	return nil
+}
+
+func (e *recordingExecutor) LastLatency() time.Duration {
+	return 0
+}
+
+func (e *recordingExecutor) Close() {
+	e.closed = true
+}
+
+type recordingBackend struct {
+	options   *BackendOptions
+	executors []*recordingExecutor
+}
+
+func (b *recordingBackend) NewExecutor() (Executor, error) {
+	exec := &recordingExecutor{}
+	b.executors = append(b.executors, exec)
+	return exec, nil
+}
+
+func (b *recordingBackend) Close() {
+}
+
+func (s *TestExecutorSuite) TestBackends(c *C) {
+	var opened []*recordingBackend
+	RegisterBackend("recording", func(options *BackendOptions) (Backend, error) {
+		backend := &recordingBackend{options: options}
+		opened = append(opened, backend)
+		return backend, nil
+	})
+	defer func() {
+		backendsMutex.Lock()
+		delete(backends, "recording")
+		backendsMutex.Unlock()
+	}()
+	registered := map[string]bool{}
+	for _, name := range Backends() {
+		registered[name] = true
+	}
+	c.Assert(registered["recording"], Equals, true)
+	c.Assert(registered["mongodb"], Equals, true)
+
+	// by url scheme
+	backend, err := OpenBackend("", &BackendOptions{Connection: ConnectionOptions{Url: "recording://host"}})
+	c.Assert(err, IsNil)
+	exec, err := backend.NewExecutor()
+	c.Assert(err, IsNil)
+	op := &Op{Type: Insert, Content: Document{"o": bson.M{"a": 1}}}
+	c.Assert(exec.Execute(op), IsNil)
+	exec.Close()
+	c.Assert(opened, HasLen, 1)
+	c.Assert(opened[0].options.Connection.Url, Equals, "recording://host")
+	c.Assert(opened[0].executors[0].ops, DeepEquals, []*Op{op})
+	c.Assert(opened[0].executors[0].closed, Equals, true)
+
+	// by name, whatever the url
+	_, err = OpenBackend("recording", &BackendOptions{Connection: ConnectionOptions{Url: "localhost:27017"}})
+	c.Assert(err, IsNil)
+	c.Assert(opened, HasLen, 2)
+
+	_, err = OpenBackend("", &BackendOptions{Connection: ConnectionOptions{Url: "postgres://host"}})
+	c.Assert(err, ErrorMatches, "unknown backend: postgres")
+
+	// the executors that keep results can be verified
+	_, ok := Executor(NewOpsExecutor(nil, nil, nil)).(ResultExecutor)
+	c.Assert(ok, Equals, true)
+	_, ok = Executor(NewDryRunExecutor()).(ResultExecutor)
+	c.Assert(ok, Equals, false)
+}
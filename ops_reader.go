@@ -2,14 +2,20 @@ package flashback
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"os"
 	"strings"
 	"time"
 
+	"github.com/klauspost/compress/zstd"
 	"github.com/mongodb/mongo-tools/common/bsonutil" // requires go 1.4
 	"github.com/mongodb/mongo-tools/common/json"
+	"gopkg.in/mgo.v2/bson"
 )
 
 // OpsReader reads the ops from a source and present an interface for consumers
@@ -39,6 +45,16 @@ type OpsReader interface {
 	Close()
 }
 
+// OpIssue tells why a record of an ops file isn't replayed. Skipped records
+// are left out on purpose, e.g. by the op filter, while rejected ones can't be
+// replayed, e.g. because they can't be parsed.
+type OpIssue struct {
+	Position int    // see Op.Position
+	OpType   OpType // the recorded op type, if any
+	Rejected bool
+	Reason   string
+}
+
 // ByLineOpsReader reads ops from a json file that is exported from python's
 // json_util module, where each line is a json-represented op.
 //
@@ -46,12 +62,15 @@ type OpsReader interface {
 // convert some "metadata" into MongoDB specific data structures, like "Object
 // Id" and datetime.
 type ByLineOpsReader struct {
-	lineReader *bufio.Reader
-	err        error
-	opsRead    int
-	closeFunc  func()
-	logger     *Logger
-	opFilters  []string
+	lineReader      *bufio.Reader
+	err             error
+	opsRead         int
+	closeFunc       func()
+	logger          *Logger
+	opFilters       []string
+	keepTextContent bool
+	position        int
+	issueHandler    func(OpIssue)
 }
 
 func NewByLineOpsReader(reader io.Reader, logger *Logger, opFilter string) (error, *ByLineOpsReader) {
@@ -68,26 +87,91 @@ func NewByLineOpsReader(reader io.Reader, logger *Logger, opFilter string) (erro
 	}
 }
 
+// Keep the original JSON text of the ops in their TextContent. It isn't
+// needed to replay them, so it is dropped by default to save memory.
+func (r *ByLineOpsReader) KeepTextContent(keep bool) {
+	r.keepTextContent = keep
+}
+
+// Pass the records that are skipped or rejected to handler, e.g. for a dry
+// run. Lines that can't be parsed are then skipped instead of ending the
+// reading.
+func (r *ByLineOpsReader) ReportIssues(handler func(OpIssue)) {
+	r.issueHandler = handler
+}
+
+// Read the next line, keeping track of its number
+func (r *ByLineOpsReader) readLine() (string, error) {
+	line, err := r.lineReader.ReadString('\n')
+	if line != "" {
+		r.position++
+	}
+	return line, err
+}
+
 // func NewCyclicOpsReader(func() ops_reader_maker *OpsReader) (error, OpsReader)
 
-func NewFileByLineOpsReader(filename string, logger *Logger, opFilter string) (error, *ByLineOpsReader) {
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// Open an ops file for reading. Compressed files (gzip or zstd) are detected
+// by their magic bytes and decompressed on the fly, so callers always see the
+// plain ops stream. The returned function releases the underlying resources.
+func openOpsFile(filename string) (io.Reader, func(), error) {
 	file, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	bufReader := bufio.NewReader(file)
+
+	// A short read is fine here: tiny files are simply not compressed.
+	magic, _ := bufReader.Peek(len(zstdMagic))
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gzReader, err := gzip.NewReader(bufReader)
+		if err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+		return gzReader, func() {
+			gzReader.Close()
+			file.Close()
+		}, nil
+	case bytes.HasPrefix(magic, zstdMagic):
+		zstdReader, err := zstd.NewReader(bufReader)
+		if err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+		return zstdReader, func() {
+			zstdReader.Close()
+			file.Close()
+		}, nil
+	}
+	return bufReader, func() {
+		file.Close()
+	}, nil
+}
+
+func NewFileByLineOpsReader(filename string, logger *Logger, opFilter string) (error, *ByLineOpsReader) {
+	file, closeFunc, err := openOpsFile(filename)
 	if err != nil {
 		return err, nil
 	}
 	err, reader := NewByLineOpsReader(file, logger, opFilter)
 	if err != nil {
+		closeFunc()
 		return err, reader
 	}
-	reader.closeFunc = func() {
-		file.Close()
-	}
+	reader.closeFunc = closeFunc
 	return nil, reader
 }
 
 func (r *ByLineOpsReader) SkipOps(numSkipOps int) error {
 	for numSkipped := 0; numSkipped < numSkipOps; numSkipped++ {
-		_, err := r.lineReader.ReadString('\n')
+		_, err := r.readLine()
 
 		// Return if we get an error reading the error, or hit EOF
 		if err != nil || err == io.EOF {
@@ -105,7 +189,7 @@ func (r *ByLineOpsReader) SetStartTime(startTime int64) (int64, error) {
 
 	for true {
 		// The nature of this function is that it will discard the first op
-		jsonText, err := r.lineReader.ReadString('\n')
+		jsonText, err := r.readLine()
 		numSkipped++
 
 		// Return if we get an error reading the error, or hit EOF
@@ -121,7 +205,7 @@ func (r *ByLineOpsReader) SetStartTime(startTime int64) (int64, error) {
 		timestamp := rawObj["ts"].(time.Time)
 		if timestamp.After(searchTime) || timestamp.Equal(searchTime) {
 			actualTime := timestamp
-			r.logger.Infof("Skipped %d ops to begin at timestamp %d.", numSkipped, actualTime)
+			r.logger.Infof("Skipped %d ops to begin at timestamp %v.", numSkipped, actualTime)
 			return numSkipped, nil
 		}
 	}
@@ -132,23 +216,41 @@ func (r *ByLineOpsReader) SetStartTime(startTime int64) (int64, error) {
 func (r *ByLineOpsReader) Next() *Op {
 	// we may need to skip certain type of ops
 	for {
-		jsonText, err := r.lineReader.ReadString('\n')
+		jsonText, err := r.readLine()
 		r.err = err
 
 		if err != nil && err != io.EOF {
 			return nil
 		}
+		if strings.TrimSpace(jsonText) == "" {
+			if err == io.EOF {
+				return nil
+			}
+			continue
+		}
 
-		rawObj, err := parseJson(jsonText)
-		r.err = err
-		if err != nil {
-			return nil
+		rawObj, parseErr := parseJson(jsonText)
+		if parseErr != nil {
+			if r.issueHandler == nil {
+				r.err = parseErr
+				return nil
+			}
+			r.issueHandler(OpIssue{Position: r.position, Rejected: true, Reason: "invalid JSON: " + parseErr.Error()})
+			continue
 		}
 		r.opsRead++
-		op := makeOp(rawObj, jsonText, r.opFilters)
+		op, issue := parseOp(rawObj, r.opFilters)
 		if op == nil {
+			if r.issueHandler != nil {
+				issue.Position = r.position
+				r.issueHandler(*issue)
+			}
 			continue
 		}
+		op.Position = r.position
+		if r.keepTextContent {
+			op.TextContent = jsonText
+		}
 
 		return op
 	}
@@ -171,7 +273,203 @@ func (r *ByLineOpsReader) Close() {
 	}
 }
 
-// Convert a json string to a raw document
+// Largest BSON document we accept from a BSON ops file. The server caps
+// documents at 16MB, and profiler entries carry a little extra on top.
+const maxBSONDocumentSize = 48 * 1024 * 1024
+
+// BSONOpsReader reads ops from a stream of length-prefixed BSON documents
+// (the same layout as a mongodump .bson file), where each document is an op.
+//
+// Unlike ByLineOpsReader, no extended JSON conversion is needed, so the ops
+// keep the exact types they were recorded with (int32 vs int64, binary
+// subtypes, etc.).
+type BSONOpsReader struct {
+	docReader *bufio.Reader
+	err       error
+	opsRead   int
+	closeFunc func()
+	logger    *Logger
+	opFilters []string
+
+	position     int
+	issueHandler func(OpIssue)
+}
+
+func NewBSONOpsReader(reader io.Reader, logger *Logger, opFilter string) (error, *BSONOpsReader) {
+	opFilters := make([]string, 0)
+	if opFilter != "" {
+		opFilters = strings.Split(opFilter, ",")
+	}
+	return nil, &BSONOpsReader{
+		docReader: bufio.NewReaderSize(reader, 5*1024*1024),
+		err:       nil,
+		opsRead:   0,
+		logger:    logger,
+		opFilters: opFilters,
+	}
+}
+
+func NewFileBSONOpsReader(filename string, logger *Logger, opFilter string) (error, *BSONOpsReader) {
+	file, closeFunc, err := openOpsFile(filename)
+	if err != nil {
+		return err, nil
+	}
+	err, reader := NewBSONOpsReader(file, logger, opFilter)
+	if err != nil {
+		closeFunc()
+		return err, reader
+	}
+	reader.closeFunc = closeFunc
+	return nil, reader
+}
+
+// Pass the records that are skipped or rejected to handler, e.g. for a dry
+// run. Documents that can't be decoded are then skipped instead of ending the
+// reading, but a stream that is cut off or corrupted can't be read further.
+func (r *BSONOpsReader) ReportIssues(handler func(OpIssue)) {
+	r.issueHandler = handler
+}
+
+// Read the next raw BSON document from the stream. io.EOF is returned only
+// if the stream ends exactly on a document boundary.
+func (r *BSONOpsReader) readDocument() ([]byte, error) {
+	var sizeBuf [4]byte
+	if _, err := io.ReadFull(r.docReader, sizeBuf[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errors.New("truncated BSON document size")
+		}
+		return nil, err
+	}
+
+	size := int(binary.LittleEndian.Uint32(sizeBuf[:]))
+	if size < 5 || size > maxBSONDocumentSize {
+		return nil, fmt.Errorf("invalid BSON document size %d", size)
+	}
+
+	doc := make([]byte, size)
+	copy(doc, sizeBuf[:])
+	if _, err := io.ReadFull(r.docReader, doc[4:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, errors.New("truncated BSON document")
+		}
+		return nil, err
+	}
+	r.position++
+	return doc, nil
+}
+
+func (r *BSONOpsReader) SkipOps(numSkipOps int) error {
+	for numSkipped := 0; numSkipped < numSkipOps; numSkipped++ {
+		if _, err := r.readDocument(); err != nil {
+			return err
+		}
+	}
+
+	r.logger.Infof("Done skipping %d ops.\n", numSkipOps)
+	return nil
+}
+
+func (r *BSONOpsReader) SetStartTime(startTime int64) (int64, error) {
+	var numSkipped int64
+	searchTime := time.Unix(startTime/1000, startTime%1000*1000000)
+
+	for {
+		// The nature of this function is that it will discard the first op
+		doc, err := r.readDocument()
+		numSkipped++
+		if err != nil {
+			return numSkipped, err
+		}
+
+		var tsOnly struct {
+			Timestamp time.Time `bson:"ts"`
+		}
+		if err := bson.Unmarshal(doc, &tsOnly); err != nil {
+			return numSkipped, err
+		}
+
+		timestamp := tsOnly.Timestamp
+		if timestamp.After(searchTime) || timestamp.Equal(searchTime) {
+			r.logger.Infof("Skipped %d ops to begin at timestamp %v.", numSkipped, timestamp)
+			return numSkipped, nil
+		}
+	}
+}
+
+func (r *BSONOpsReader) Next() *Op {
+	// we may need to skip certain type of ops
+	for {
+		doc, err := r.readDocument()
+		r.err = err
+		if err != nil {
+			if err != io.EOF && r.issueHandler != nil {
+				r.issueHandler(OpIssue{Position: r.position + 1, Rejected: true, Reason: err.Error()})
+			}
+			return nil
+		}
+
+		rawObj, err := decodeDocument(doc)
+		if err != nil {
+			if r.issueHandler == nil {
+				r.err = err
+				return nil
+			}
+			r.issueHandler(OpIssue{Position: r.position, Rejected: true, Reason: "invalid BSON: " + err.Error()})
+			continue
+		}
+		r.opsRead++
+		op, issue := parseOp(rawObj, r.opFilters)
+		if op == nil {
+			if r.issueHandler != nil {
+				issue.Position = r.position
+				r.issueHandler(*issue)
+			}
+			continue
+		}
+		op.Position = r.position
+
+		return op
+	}
+}
+
+func (r *BSONOpsReader) OpsRead() int {
+	return r.opsRead
+}
+
+func (r *BSONOpsReader) AllLoaded() bool {
+	return r.err == io.EOF
+}
+
+func (r *BSONOpsReader) Err() error {
+	return r.err
+}
+
+func (r *BSONOpsReader) Close() {
+	if r.closeFunc != nil {
+		r.closeFunc()
+	}
+}
+
+// Decode a raw BSON document. It is unmarshalled into a plain map so that
+// nested documents are decoded as map[string]interface{}, the same as with the
+// JSON readers.
+func decodeDocument(doc []byte) (Document, error) {
+	rawObj := map[string]interface{}{}
+	if err := bson.Unmarshal(doc, &rawObj); err != nil {
+		return nil, err
+	}
+	if needsKeyOrder(rawObj) {
+		var ordered bson.D
+		if err := bson.Unmarshal(doc, &ordered); err != nil {
+			return nil, err
+		}
+		preserveKeyOrder(rawObj, keyOrderOfD(ordered))
+	}
+	return Document(rawObj), nil
+}
+
+// Convert a json string to a raw document. The parts of the document whose
+// key order matters for the replay are decoded as bson.D.
 func parseJson(jsonText string) (Document, error) {
 	rawObj := Document{}
 	err := json.Unmarshal([]byte(jsonText), &rawObj)
@@ -179,8 +477,13 @@ func parseJson(jsonText string) (Document, error) {
 	if err != nil {
 		return rawObj, err
 	}
-	err = normalizeObj(rawObj)
-	return rawObj, err
+	if err = normalizeObj(rawObj); err != nil {
+		return rawObj, err
+	}
+	if needsKeyOrder(rawObj) {
+		preserveKeyOrder(rawObj, scanKeyOrder(jsonText))
+	}
+	return rawObj, nil
 }
 
 // Convert mongo extended json types from their strict JSON representation
@@ -201,13 +504,16 @@ func PruneEmptyUpdateObj(doc Document, opType string) {
 
 	if opType == "command" {
 		// only do this for findandmodify
-		command := doc["command"].(map[string]interface{})
-		if command["findandmodify"] == nil {
+		command, ok := asMap(doc["command"])
+		if !ok {
+			return
+		}
+		if _, exist := lookupCommand(command, "findandmodify"); !exist {
 			return
 		}
-		updateObj = command["update"].(map[string]interface{})
+		updateObj, _ = command["update"].(map[string]interface{})
 	} else if opType == "update" {
-		updateObj = doc["updateobj"].(map[string]interface{})
+		updateObj, _ = doc["updateobj"].(map[string]interface{})
 	} else {
 		return
 	}
@@ -216,24 +522,100 @@ func PruneEmptyUpdateObj(doc Document, opType string) {
 
 	for _, operator := range operators {
 		if updateObj[operator] != nil {
-			checkMap := updateObj[operator].(map[string]interface{})
-			if len(checkMap) == 0 {
+			checkMap, ok := updateObj[operator].(map[string]interface{})
+			if ok && len(checkMap) == 0 {
 				delete(updateObj, operator)
 			}
 		}
 	}
 }
 
-// Create an Op object given an unmarshalled mongo doc, the original JSON
-// text from the input file, and a list of op filters
-func makeOp(rawDoc Document, rawText string, opFilters []string) *Op {
-	opType := rawDoc["op"].(string)
-	ts := rawDoc["ts"].(time.Time)
-	ns := rawDoc["ns"].(string)
+// Find a command by name in a command document. Command names are matched
+// case-insensitively, since older servers record e.g. "findandmodify" while
+// newer ones record "findAndModify".
+func lookupCommand(cmd map[string]interface{}, name string) (interface{}, bool) {
+	if value, exist := cmd[name]; exist {
+		return value, true
+	}
+	for key, value := range cmd {
+		if strings.EqualFold(key, name) {
+			return value, true
+		}
+	}
+	return nil, false
+}
+
+// Since MongoDB 3.2, finds are recorded as "find" commands, either in the
+// "command" field (3.6+) or in the "query" field (3.2 and 3.4) of the op.
+// Returns the find command, or nil if the op is a legacy query.
+func findCommand(rawDoc Document) map[string]interface{} {
+	for _, field := range []string{"command", "query"} {
+		cmd, ok := asMap(rawDoc[field])
+		if !ok {
+			continue
+		}
+		if _, ok := cmd["find"].(string); ok {
+			return cmd
+		}
+	}
+	return nil
+}
+
+// The legacy profiler doesn't record whether a write was meant to affect
+// multiple documents, but we can tell from the number of documents it
+// actually affected.
+func affectedMany(rawDoc Document, counters ...string) bool {
+	for _, counter := range counters {
+		if n, err := safeGetInt(rawDoc[counter]); err == nil && n > 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// Create an Op object given an unmarshalled mongo doc and a list of op filters
+//
+// Both the legacy profiler format and the command-style format of MongoDB
+// 3.6+ are accepted. Writes are normalized into the legacy shape, while find
+// commands are kept as commands and turned into queries by CanonicalizeOp.
+func makeOp(rawDoc Document, opFilters []string) *Op {
+	op, _ := parseOp(rawDoc, opFilters)
+	return op
+}
+
+// Create an op from a raw document like makeOp, or tell why there is none.
+func parseOp(rawDoc Document, opFilters []string) (*Op, *OpIssue) {
+	opType, ok := rawDoc["op"].(string)
+	if !ok {
+		return nil, &OpIssue{Rejected: true, Reason: "missing or invalid op"}
+	}
+	rejected := func(reason string) (*Op, *OpIssue) {
+		return nil, &OpIssue{OpType: OpType(opType), Rejected: true, Reason: reason}
+	}
+	skipped := func(reason string) (*Op, *OpIssue) {
+		return nil, &OpIssue{OpType: OpType(opType), Reason: reason}
+	}
+	ts, ok := rawDoc["ts"].(time.Time)
+	if !ok {
+		return rejected("missing or invalid ts")
+	}
+	ns, ok := rawDoc["ns"].(string)
+	if !ok {
+		return rejected("missing or invalid ns")
+	}
 	parts := strings.SplitN(ns, ".", 2)
+	if len(parts) != 2 {
+		return rejected("namespace without a collection")
+	}
 	dbName, collName := parts[0], parts[1]
 
-	if len(opFilters) != 0 {
+	// Modern profiler entries carry the original write command instead of
+	// the top level "query"/"updateobj"/"o" fields.
+	command, _ := asMap(rawDoc["command"])
+
+	// Transactions are replayed as a whole, so the commands ending them are
+	// kept whatever the filters.
+	if _, ends := transactionEnd(command); len(opFilters) != 0 && !ends {
 		filtered := false
 		for _, opFilter := range opFilters {
 			if opType == opFilter {
@@ -242,7 +624,7 @@ func makeOp(rawDoc Document, rawText string, opFilters []string) *Op {
 			}
 		}
 		if filtered == false {
-			return nil
+			return skipped("filtered out")
 		}
 	}
 
@@ -251,17 +633,40 @@ func makeOp(rawDoc Document, rawText string, opFilters []string) *Op {
 	// we only handpick the fields that will be of useful for a given op type.
 	switch opType {
 	case "insert":
-		content = Document{"o": rawDoc["o"].(map[string]interface{})}
+		if o, ok := rawDoc["o"].(map[string]interface{}); ok {
+			content = Document{"o": o}
+		} else if docs, ok := command["documents"].([]interface{}); ok && len(docs) > 0 {
+			content = Document{"o": docs}
+		} else {
+			return rejected("insert without documents")
+		}
 	case "query":
+		if cmd := findCommand(rawDoc); cmd != nil {
+			opType = "command"
+			content = Document{"command": cmd}
+			break
+		}
 		content = Document{
 			"query":     rawDoc["query"],
+			"fields":    rawDoc["returnFieldSelector"],
 			"ntoreturn": rawDoc["ntoreturn"],
 			"ntoskip":   rawDoc["ntoskip"],
 		}
+		if rawDoc["fields"] != nil {
+			content["fields"] = rawDoc["fields"]
+		}
 	case "update":
 		content = Document{
 			"query":     rawDoc["query"],
 			"updateobj": rawDoc["updateobj"],
+			"multi":     rawDoc["multi"] == true || affectedMany(rawDoc, "nMatched", "nModified", "nupdated"),
+			"upsert":    rawDoc["upsert"] == true,
+		}
+		if command != nil && command["u"] != nil {
+			content["query"] = command["q"]
+			content["updateobj"] = command["u"]
+			content["multi"] = command["multi"] == true
+			content["upsert"] = command["upsert"] == true
 		}
 
 		PruneEmptyUpdateObj(content, opType)
@@ -269,11 +674,32 @@ func makeOp(rawDoc Document, rawText string, opFilters []string) *Op {
 		content = Document{"command": rawDoc["command"]}
 		PruneEmptyUpdateObj(content, opType)
 	case "remove":
-		content = Document{"query": rawDoc["query"]}
+		content = Document{
+			"query":   rawDoc["query"],
+			"justOne": !affectedMany(rawDoc, "ndeleted"),
+		}
+		if justOne, ok := rawDoc["justOne"].(bool); ok {
+			content["justOne"] = justOne
+		}
+		if command != nil && command["q"] != nil {
+			content["query"] = command["q"]
+			limit, _ := safeGetInt(command["limit"])
+			content["justOne"] = limit == 1
+		}
 	default:
-		return nil
+		return skipped("unsupported op type")
 	}
-	return &Op{dbName, collName, OpType(opType), ts, content, rawText}
+
+	// Keep the write concern writes were recorded with, so that it can be
+	// replayed if asked to.
+	if opType == "insert" || opType == "update" || opType == "remove" {
+		if command != nil && command["writeConcern"] != nil {
+			content["writeConcern"] = command["writeConcern"]
+		}
+	}
+	op := &Op{Database: dbName, Collection: collName, Type: OpType(opType), Timestamp: ts, Content: content}
+	op.Session, op.TxnNumber = transactionOf(rawDoc, command)
+	return op, nil
 }
 
 type CyclicOpsReader struct {
@@ -282,6 +708,7 @@ type CyclicOpsReader struct {
 	previousRead int
 	err          error
 	logger       *Logger
+	cycle        int
 }
 
 func NewCyclicOpsReader(maker func() OpsReader, logger *Logger) *CyclicOpsReader {
@@ -296,6 +723,7 @@ func NewCyclicOpsReader(maker func() OpsReader, logger *Logger) *CyclicOpsReader
 		0,
 		nil,
 		logger,
+		0,
 	}
 }
 
@@ -306,11 +734,14 @@ func (c *CyclicOpsReader) Next() *Op {
 		c.previousRead += c.reader.OpsRead()
 		c.reader.Close()
 		c.reader = c.maker()
+		c.cycle++
 		op = c.reader.Next()
 	}
 	if op == nil {
 		c.err = errors.New("The underlying ops reader is empty or invalid")
+		return nil
 	}
+	op.Cycle = c.cycle
 	return op
 
 }
@@ -2,10 +2,16 @@ package flashback
 
 import (
 	"bytes"
+	"compress/gzip"
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/klauspost/compress/zstd"
 	. "gopkg.in/check.v1"
 	"gopkg.in/mgo.v2/bson"
 )
@@ -149,6 +155,110 @@ func (s *TestFileByLineOpsReaderSuite) TestFileByLineOpsReader(c *C) {
 	CheckSetStartTime(c, loader)
 }
 
+func (s *TestFileByLineOpsReaderSuite) TestBSONOpsReader(c *C) {
+	logger, _ = NewLogger("", "")
+
+	var buf bytes.Buffer
+	for i := 1; i <= 5; i++ {
+		doc, err := bson.Marshal(bson.D{
+			{Name: "ts", Value: time.Unix(0, int64(1396456709420+i)*1e6)},
+			{Name: "ns", Value: "db.coll"},
+			{Name: "op", Value: "insert"},
+			{Name: "o", Value: bson.D{
+				{Name: fmt.Sprintf("logType%d", i), Value: "warning"},
+				{Name: "message", Value: fmt.Sprintf("m%d", i)},
+			}},
+		})
+		c.Assert(err, IsNil)
+		buf.Write(doc)
+	}
+	testBSON := buf.Bytes()
+
+	err, loader := NewBSONOpsReader(bytes.NewReader(testBSON), logger, "")
+	c.Assert(err, Equals, nil)
+	CheckOpsReader(c, loader)
+	c.Assert(loader.AllLoaded(), Equals, true)
+
+	// Reset the reader so that we can test SkipOps
+	err, loader = NewBSONOpsReader(bytes.NewReader(testBSON), logger, "")
+	c.Assert(err, Equals, nil)
+	CheckSkipOps(c, loader)
+
+	// Reset the reader so that we can test SetStartTime
+	err, loader = NewBSONOpsReader(bytes.NewReader(testBSON), logger, "")
+	c.Assert(err, Equals, nil)
+	CheckSetStartTime(c, loader)
+
+	// A truncated document is reported as an error rather than EOF
+	err, loader = NewBSONOpsReader(bytes.NewReader(testBSON[:len(testBSON)-3]), logger, "")
+	c.Assert(err, Equals, nil)
+	for op := loader.Next(); op != nil; op = loader.Next() {
+	}
+	c.Assert(loader.OpsRead(), Equals, 4)
+	c.Assert(loader.AllLoaded(), Equals, false)
+	c.Assert(loader.Err(), NotNil)
+}
+
+func (s *TestFileByLineOpsReaderSuite) TestCompressedFileByLineOpsReader(c *C) {
+	logger, _ = NewLogger("", "")
+
+	testJsonString :=
+		`{ "ts": {"$date" : 1396456709421}, "ns": "db.coll", "op": "insert", "o": {"logType1": "warning", "message": "m1"} }
+        { "ts": {"$date": 1396456709422}, "ns": "db.coll", "op": "insert", "o": {"logType2": "warning", "message": "m2"} }
+        { "ts": {"$date": 1396456709423}, "ns": "db.coll", "op": "insert", "o": {"logType3": "warning", "message": "m3"} }
+        { "ts": {"$date": 1396456709424}, "ns": "db.coll", "op": "insert", "o": {"logType4": "warning", "message": "m4"} }
+        { "ts": {"$date": 1396456709425}, "ns": "db.coll", "op": "insert", "o": {"logType5": "warning", "message": "m5"} }`
+
+	writeFile := func(name string, compress func(io.Writer) io.WriteCloser) string {
+		filename := filepath.Join(c.MkDir(), name)
+		file, err := os.Create(filename)
+		c.Assert(err, IsNil)
+		defer file.Close()
+		w := compress(file)
+		_, err = w.Write([]byte(testJsonString))
+		c.Assert(err, IsNil)
+		c.Assert(w.Close(), IsNil)
+		return filename
+	}
+	gzipFile := writeFile("ops.json.gz", func(w io.Writer) io.WriteCloser {
+		return gzip.NewWriter(w)
+	})
+	zstdFile := writeFile("ops.json.zst", func(w io.Writer) io.WriteCloser {
+		zw, err := zstd.NewWriter(w)
+		c.Assert(err, IsNil)
+		return zw
+	})
+
+	for _, filename := range []string{gzipFile, zstdFile} {
+		err, loader := NewFileByLineOpsReader(filename, logger, "")
+		c.Assert(err, IsNil)
+		CheckOpsReader(c, loader)
+		loader.Close()
+
+		err, loader = NewFileByLineOpsReader(filename, logger, "")
+		c.Assert(err, IsNil)
+		CheckSkipOps(c, loader)
+		loader.Close()
+
+		err, loader = NewFileByLineOpsReader(filename, logger, "")
+		c.Assert(err, IsNil)
+		CheckSetStartTime(c, loader)
+		loader.Close()
+
+		// Cycling over a compressed file reopens and decompresses it again
+		cyclic := NewCyclicOpsReader(func() OpsReader {
+			err, loader := NewFileByLineOpsReader(filename, logger, "")
+			c.Assert(err, IsNil)
+			return loader
+		}, logger)
+		for i := 0; i < 12; i++ {
+			c.Assert(cyclic.Next(), NotNil)
+		}
+		c.Assert(cyclic.OpsRead(), Equals, 12)
+		cyclic.Close()
+	}
+}
+
 func (s *TestFileByLineOpsReaderSuite) TestOpFilter(c *C) {
 	logger, _ = NewLogger("", "")
 	fmt.Println("opfilter")
@@ -175,6 +285,424 @@ func (s *TestFileByLineOpsReaderSuite) TestOpFilter(c *C) {
 	test("update,insert,command", 3)
 }
 
+func (s *TestFileByLineOpsReaderSuite) TestReportIssues(c *C) {
+	logger, _ = NewLogger("", "")
+
+	testJsonString :=
+		`{ "ts": {"$date": 1396456709421}, "ns": "db.coll", "op": "insert", "o": {"message": "m1"} }
+		 { "ts": {"$date": 1396456709422}, "ns": "db.coll", "op": "insert", "o":
+
+		 { "ts": {"$date": 1396456709423}, "ns": "db.coll", "op": "getmore" }
+		 { "ns": "db.coll", "op": "query", "query": {} }
+		 { "ts": {"$date": 1396456709425}, "ns": "db.coll", "op": "update", "query": {}, "updateobj": {"$set": {"a": 1}} }
+		 { "ts": {"$date": 1396456709426}, "ns": "db.coll", "op": "insert", "o": {"message": "m2"} }`
+
+	// without a handler, the reading ends at the first line that can't be
+	// parsed
+	err, loader := NewByLineOpsReader(strings.NewReader(testJsonString), logger, "insert,query,getmore")
+	c.Assert(err, IsNil)
+	c.Assert(loader.Next(), NotNil)
+	c.Assert(loader.Next(), IsNil)
+	c.Assert(loader.Err(), NotNil)
+
+	err, loader = NewByLineOpsReader(strings.NewReader(testJsonString), logger, "insert,query,getmore")
+	c.Assert(err, IsNil)
+	var issues []OpIssue
+	loader.ReportIssues(func(issue OpIssue) {
+		issues = append(issues, issue)
+	})
+	var positions []int
+	for op := loader.Next(); op != nil; op = loader.Next() {
+		positions = append(positions, op.Position)
+	}
+	c.Assert(positions, DeepEquals, []int{1, 7})
+	c.Assert(loader.AllLoaded(), Equals, true)
+
+	c.Assert(issues, HasLen, 4)
+	c.Assert(issues[0].Position, Equals, 2)
+	c.Assert(issues[0].Rejected, Equals, true)
+	c.Assert(strings.HasPrefix(issues[0].Reason, "invalid JSON: "), Equals, true)
+	c.Assert(issues[1:], DeepEquals, []OpIssue{
+		{Position: 4, OpType: "getmore", Reason: "unsupported op type"},
+		{Position: 5, OpType: "query", Rejected: true, Reason: "missing or invalid ts"},
+		{Position: 6, OpType: "update", Reason: "filtered out"},
+	})
+
+	// BSON documents are numbered
+	var buf bytes.Buffer
+	for i := 1; i <= 3; i++ {
+		op := bson.D{
+			{Name: "ts", Value: time.Unix(0, int64(1396456709420+i)*1e6)},
+			{Name: "ns", Value: "db.coll"},
+			{Name: "op", Value: "insert"},
+			{Name: "o", Value: bson.D{{Name: "i", Value: i}}},
+		}
+		if i == 2 {
+			op[1].Value = "db"
+		}
+		doc, err := bson.Marshal(op)
+		c.Assert(err, IsNil)
+		buf.Write(doc)
+	}
+	err, bsonLoader := NewBSONOpsReader(&buf, logger, "")
+	c.Assert(err, IsNil)
+	issues = nil
+	bsonLoader.ReportIssues(func(issue OpIssue) {
+		issues = append(issues, issue)
+	})
+	positions = nil
+	for op := bsonLoader.Next(); op != nil; op = bsonLoader.Next() {
+		positions = append(positions, op.Position)
+	}
+	c.Assert(positions, DeepEquals, []int{1, 3})
+	c.Assert(issues, DeepEquals, []OpIssue{
+		{Position: 2, OpType: Insert, Rejected: true, Reason: "namespace without a collection"},
+	})
+}
+
+func (s *TestFileByLineOpsReaderSuite) TestModernProfilerSchema(c *C) {
+	logger, _ = NewLogger("", "")
+
+	testJsonString :=
+		`{"op": "query", "ns": "db.coll", "command": {"find": "coll", "filter": {"a": 1}, "sort": {"b": -1, "a": 1}, "limit": 10, "skip": 5, "$db": "db"}, "ts": {"$date": 1396456709421}}
+		 {"op": "command", "ns": "db.$cmd", "command": {"find": "coll2", "filter": {"a": 2}, "limit": 1, "singleBatch": true}, "ts": {"$date": 1396456709422}}
+		 {"op": "query", "ns": "db.coll", "query": {"find": "coll", "filter": {"a": 3}}, "ts": {"$date": 1396456709423}}
+		 {"op": "update", "ns": "db.coll", "command": {"q": {"_id": 1}, "u": {"$set": {"x": 1}, "$unset": {}}, "multi": true, "upsert": false}, "ts": {"$date": 1396456709424}}
+		 {"op": "remove", "ns": "db.coll", "command": {"q": {"_id": 2}, "limit": 0}, "ts": {"$date": 1396456709425}}
+		 {"op": "command", "ns": "db.coll", "command": {"findAndModify": "coll", "query": {"_id": 3}, "update": {"$inc": {"n": 1}, "$set": {}}}, "ts": {"$date": 1396456709426}}
+		 {"op": "getmore", "ns": "db.coll", "command": {"getMore": 12345, "collection": "coll"}, "ts": {"$date": 1396456709427}}
+		 {"op": "insert", "ns": "db.coll", "command": {"insert": "coll", "documents": [{"_id": 4}, {"_id": 5}]}, "ts": {"$date": 1396456709428}}`
+	reader := bytes.NewReader([]byte(testJsonString))
+	err, loader := NewByLineOpsReader(reader, logger, "")
+	c.Assert(err, Equals, nil)
+
+	ops := []*Op{}
+	for op := loader.Next(); op != nil; op = loader.Next() {
+		ops = append(ops, CanonicalizeOp(op))
+	}
+	c.Assert(loader.OpsRead(), Equals, 8)
+	c.Assert(len(ops), Equals, 7)
+
+	// find commands become queries, whichever field they were recorded in
+	for i, collName := range []string{"coll", "coll2", "coll"} {
+		c.Assert(ops[i].Type, Equals, Query)
+		c.Assert(ops[i].Database, Equals, "db")
+		c.Assert(ops[i].Collection, Equals, collName)
+		q := ops[i].Content["query"].(map[string]interface{})
+		c.Assert(q["$query"], NotNil)
+	}
+	q := ops[0].Content["query"].(map[string]interface{})
+	c.Assert(q["$orderby"], NotNil)
+	c.Assert(keyNames(q["$orderby"]), DeepEquals, []string{"b", "a"})
+	ntoreturn, err := safeGetInt(ops[0].Content["ntoreturn"])
+	c.Assert(err, IsNil)
+	c.Assert(ntoreturn, Equals, 10)
+	ntoskip, err := safeGetInt(ops[0].Content["ntoskip"])
+	c.Assert(err, IsNil)
+	c.Assert(ntoskip, Equals, 5)
+	ntoreturn, err = safeGetInt(ops[1].Content["ntoreturn"])
+	c.Assert(err, IsNil)
+	c.Assert(ntoreturn, Equals, -1)
+
+	// writes are normalized into the legacy shape
+	c.Assert(ops[3].Type, Equals, Update)
+	c.Assert(ops[3].Content["query"], NotNil)
+	updateObj := ops[3].Content["updateobj"].(map[string]interface{})
+	c.Assert(updateObj["$set"], NotNil)
+	c.Assert(updateObj["$unset"], IsNil)
+	c.Assert(ops[3].Content["multi"], Equals, true)
+	c.Assert(ops[3].Content["upsert"], Equals, false)
+
+	c.Assert(ops[4].Type, Equals, Remove)
+	c.Assert(ops[4].Content["query"], NotNil)
+	c.Assert(ops[4].Content["justOne"], Equals, false)
+
+	c.Assert(ops[5].Type, Equals, FindAndModify)
+	c.Assert(ops[5].Collection, Equals, "coll")
+	update := ops[5].Content["update"].(map[string]interface{})
+	c.Assert(update["$set"], IsNil)
+
+	c.Assert(ops[6].Type, Equals, Insert)
+	c.Assert(len(ops[6].Content["o"].([]interface{})), Equals, 2)
+}
+
+func (s *TestFileByLineOpsReaderSuite) TestQueryModifiers(c *C) {
+	logger, _ = NewLogger("", "")
+
+	testJsonString :=
+		`{"op": "query", "ns": "db.coll", "query": {"$query": {"a": 1}, "$comment": "legacy", "$max": {"a": 5}}, "returnFieldSelector": {"a": 1}, "ntoreturn": 0, "ntoskip": 0, "ts": {"$date": 1396456709421}}
+		 {"op": "query", "ns": "db.coll", "command": {"find": "coll", "filter": {"a": 1}, "projection": {"b": 0}, "batchSize": 20, "comment": "modern", "min": {"a": 1}, "returnKey": true, "$readPreference": {"mode": "secondaryPreferred"}}, "ts": {"$date": 1396456709422}}`
+	reader := bytes.NewReader([]byte(testJsonString))
+	err, loader := NewByLineOpsReader(reader, logger, "")
+	c.Assert(err, Equals, nil)
+
+	ops := []*Op{}
+	for op := loader.Next(); op != nil; op = loader.Next() {
+		ops = append(ops, CanonicalizeOp(op))
+	}
+	c.Assert(len(ops), Equals, 2)
+
+	c.Assert(ops[0].Content["fields"], NotNil)
+	q := ops[0].Content["query"].(map[string]interface{})
+	c.Assert(q["$comment"], Equals, "legacy")
+	c.Assert(q["$max"], NotNil)
+
+	// find command options are turned into the equivalent legacy modifiers
+	c.Assert(ops[1].Type, Equals, Query)
+	c.Assert(ops[1].Content["fields"], NotNil)
+	c.Assert(ops[1].Content["batchSize"], NotNil)
+	q = ops[1].Content["query"].(map[string]interface{})
+	c.Assert(q["$comment"], Equals, "modern")
+	c.Assert(q["$min"], NotNil)
+	c.Assert(q["$returnKey"], Equals, true)
+	c.Assert(q["$readPreference"], NotNil)
+}
+
+func (s *TestFileByLineOpsReaderSuite) TestLegacyWriteOptions(c *C) {
+	logger, _ = NewLogger("", "")
+
+	testJsonString :=
+		`{"op": "update", "ns": "db.coll", "query": {"a": 1}, "updateobj": {"$set": {"b": 1}}, "nMatched": 1, "nModified": 1, "ts": {"$date": 1396456709421}}
+		 {"op": "update", "ns": "db.coll", "query": {"a": 1}, "updateobj": {"$set": {"b": 1}}, "nMatched": 7, "nModified": 7, "upsert": true, "ts": {"$date": 1396456709422}}
+		 {"op": "remove", "ns": "db.coll", "query": {"a": 1}, "ndeleted": 1, "ts": {"$date": 1396456709423}}
+		 {"op": "remove", "ns": "db.coll", "query": {"a": 1}, "ndeleted": 3, "ts": {"$date": 1396456709424}}
+		 {"op": "insert", "ns": "db.coll", "command": {"insert": "coll", "documents": [{"a": 1}], "writeConcern": {"w": "majority"}}, "ts": {"$date": 1396456709425}}`
+	reader := bytes.NewReader([]byte(testJsonString))
+	err, loader := NewByLineOpsReader(reader, logger, "")
+	c.Assert(err, Equals, nil)
+
+	ops := []*Op{}
+	for op := loader.Next(); op != nil; op = loader.Next() {
+		ops = append(ops, op)
+	}
+	c.Assert(len(ops), Equals, 5)
+
+	c.Assert(ops[0].Content["multi"], Equals, false)
+	c.Assert(ops[0].Content["upsert"], Equals, false)
+	c.Assert(ops[1].Content["multi"], Equals, true)
+	c.Assert(ops[1].Content["upsert"], Equals, true)
+	c.Assert(ops[2].Content["justOne"], Equals, true)
+	c.Assert(ops[3].Content["justOne"], Equals, false)
+
+	// the recorded write concern is kept, in case it is replayed
+	c.Assert(ops[0].Content["writeConcern"], IsNil)
+	writeConcern := ops[4].Content["writeConcern"].(map[string]interface{})
+	c.Assert(writeConcern["w"], Equals, "majority")
+}
+
+func (s *TestFileByLineOpsReaderSuite) TestTransactions(c *C) {
+	logger, _ = NewLogger("", "")
+
+	testJsonString :=
+		`{"op": "insert", "ns": "db.coll", "command": {"insert": "coll", "documents": [{"a": 1}], "lsid": {"id": "s1"}, "txnNumber": 1, "startTransaction": true, "autocommit": false}, "ts": {"$date": 1396456709420}}
+		 {"op": "update", "ns": "db.coll", "command": {"q": {"a": 1}, "u": {"$set": {"b": 1}}}, "lsid": {"id": "s1"}, "txnNumber": 1, "autocommit": false, "ts": {"$date": 1396456709421}}
+		 {"op": "insert", "ns": "db.other", "command": {"insert": "other", "documents": [{"a": 2}]}, "ts": {"$date": 1396456709422}}
+		 {"op": "command", "ns": "admin.$cmd", "command": {"commitTransaction": 1, "writeConcern": {"w": "majority"}, "lsid": {"id": "s1"}, "txnNumber": 1, "autocommit": false}, "ts": {"$date": 1396456709423}}
+		 {"op": "insert", "ns": "db.coll", "command": {"insert": "coll", "documents": [{"a": 3}], "lsid": {"id": "s1"}, "txnNumber": 2}, "ts": {"$date": 1396456709424}}
+		 {"op": "query", "ns": "db.coll", "command": {"find": "coll", "filter": {"a": 1}, "lsid": {"id": "s2"}, "txnNumber": 5, "startTransaction": true, "autocommit": false}, "ts": {"$date": 1396456709425}}
+		 {"op": "command", "ns": "admin.$cmd", "command": {"abortTransaction": 1, "lsid": {"id": "s2"}, "txnNumber": 5, "autocommit": false}, "ts": {"$date": 1396456709426}}
+		 {"op": "insert", "ns": "db.coll", "command": {"insert": "coll", "documents": [{"a": 4}], "lsid": {"id": "s1"}, "txnNumber": 3, "startTransaction": true, "autocommit": false}, "ts": {"$date": 1396456709427}}
+		 {"op": "insert", "ns": "db.coll", "command": {"insert": "coll", "documents": [{"a": 5}], "lsid": {"id": "s2"}, "txnNumber": 6, "startTransaction": true, "autocommit": false}, "ts": {"$date": 1396456709428}}
+		 {"op": "insert", "ns": "db.coll", "command": {"insert": "coll", "documents": [{"a": 6}], "lsid": {"id": "s2"}, "txnNumber": 7, "startTransaction": true, "autocommit": false}, "ts": {"$date": 1396456709429}}`
+	readAll := func(opFilter string) []*Op {
+		err, reader := NewByLineOpsReader(bytes.NewReader([]byte(testJsonString)), logger, opFilter)
+		c.Assert(err, IsNil)
+		loader := NewTransactionOpsReader(reader, logger)
+		ops := []*Op{}
+		for op := loader.Next(); op != nil; op = loader.Next() {
+			ops = append(ops, op)
+		}
+		c.Assert(loader.OpsRead(), Equals, 10)
+		c.Assert(loader.NeverEnded(), Equals, 3)
+		return ops
+	}
+
+	ops := readAll("")
+	c.Assert(len(ops), Equals, 7)
+
+	// ops outside of transactions are returned as they are read, including
+	// retryable writes
+	c.Assert(ops[0].Collection, Equals, "other")
+	c.Assert(ops[0].Session, Equals, "")
+	c.Assert(ops[2].Type, Equals, Insert)
+	c.Assert(ops[2].Session, Equals, "")
+
+	// transactions are returned when they end
+	c.Assert(ops[1].Type, Equals, Transaction)
+	c.Assert(ops[1].TxnNumber, Equals, int64(1))
+	c.Assert(ops[1].Content["commit"], Equals, true)
+	c.Assert(ops[1].Content["writeConcern"], NotNil)
+	c.Assert(len(ops[1].Ops), Equals, 2)
+	c.Assert(ops[1].Ops[0].Type, Equals, Insert)
+	c.Assert(ops[1].Ops[1].Type, Equals, Update)
+	c.Assert(ops[1].Timestamp, Equals, ops[1].Ops[0].Timestamp)
+	c.Assert(ops[1].EndTimestamp.Sub(ops[1].Timestamp), Equals, 3*time.Millisecond)
+
+	c.Assert(ops[3].Type, Equals, Transaction)
+	c.Assert(ops[3].Content["commit"], Equals, false)
+	c.Assert(len(ops[3].Ops), Equals, 1)
+	c.Assert(CanonicalizeOp(ops[3]).Ops[0].Type, Equals, Query)
+	c.Assert(ops[3].EndTimestamp.Sub(ops[3].Timestamp), Equals, time.Millisecond)
+
+	// transactions that never end are committed, when their session starts
+	// another one or at the end of the source, and end with the last op read
+	// by then
+	c.Assert(ops[4].Type, Equals, Transaction)
+	c.Assert(ops[4].TxnNumber, Equals, int64(6))
+	c.Assert(ops[4].Content["commit"], Equals, true)
+	c.Assert(ops[4].EndTimestamp.Sub(ops[4].Timestamp), Equals, time.Millisecond)
+	c.Assert(ops[5].TxnNumber, Equals, int64(3))
+	c.Assert(ops[5].Content["commit"], Equals, true)
+	c.Assert(len(ops[5].Ops), Equals, 1)
+	c.Assert(ops[5].EndTimestamp.Sub(ops[5].Timestamp), Equals, 2*time.Millisecond)
+	c.Assert(ops[6].TxnNumber, Equals, int64(7))
+
+	// the commands ending transactions are kept whatever the filters, and
+	// transactions left without ops are dropped
+	ops = readAll("insert")
+	c.Assert(len(ops), Equals, 6)
+	c.Assert(ops[1].Type, Equals, Transaction)
+	c.Assert(len(ops[1].Ops), Equals, 1)
+	c.Assert(ops[1].Content["commit"], Equals, true)
+	c.Assert(ops[3].Type, Equals, Transaction)
+	c.Assert(ops[3].TxnNumber, Equals, int64(6))
+
+	// a transaction doesn't outlive the cycle it started in, even if its
+	// session and transaction number come back in the next one
+	cyclic := NewCyclicOpsReader(func() OpsReader {
+		err, reader := NewByLineOpsReader(bytes.NewReader([]byte(
+			`{"op": "insert", "ns": "db.coll", "command": {"insert": "coll", "documents": [{"a": 1}], "lsid": {"id": "s1"}, "txnNumber": 1, "startTransaction": true, "autocommit": false}, "ts": {"$date": 1396456709420}}
+			 {"op": "insert", "ns": "db.other", "command": {"insert": "other", "documents": [{"a": 2}]}, "ts": {"$date": 1396456709421}}`)),
+			logger, "")
+		c.Assert(err, IsNil)
+		return reader
+	}, logger)
+	loader := NewTransactionOpsReader(cyclic, logger)
+	for cycle := 0; cycle < 3; cycle++ {
+		if cycle > 0 {
+			txn := loader.Next()
+			c.Assert(txn.Type, Equals, Transaction)
+			c.Assert(txn.Cycle, Equals, cycle-1)
+			c.Assert(txn.EndTimestamp.Sub(txn.Timestamp), Equals, time.Millisecond)
+			c.Assert(txn.Content["commit"], Equals, true)
+			c.Assert(len(txn.Ops), Equals, 1)
+		}
+		op := loader.Next()
+		c.Assert(op.Collection, Equals, "other")
+		c.Assert(op.Cycle, Equals, cycle)
+	}
+	c.Assert(loader.NeverEnded(), Equals, 2)
+}
+
+// Get the keys of a document decoded as a bson.D, in order.
+func keyNames(doc interface{}) []string {
+	names := []string{}
+	if d, ok := doc.(bson.D); ok {
+		for _, elem := range d {
+			names = append(names, elem.Name)
+		}
+	}
+	return names
+}
+
+func CheckKeyOrder(c *C, ops []*Op) {
+	c.Assert(len(ops), Equals, 4)
+
+	q := ops[0].Content["query"].(map[string]interface{})
+	c.Assert(keyNames(q["$orderby"]), DeepEquals, []string{"z", "a", "m"})
+	c.Assert(keyNames(q["$hint"]), DeepEquals, []string{"z", "a", "m"})
+
+	c.Assert(CommandName(ops[1]), Equals, "createIndexes")
+	indexes := CanonicalizeOp(ops[1]).Content["indexes"].([]interface{})
+	c.Assert(len(indexes), Equals, 2)
+	c.Assert(keyNames(indexes[0].(map[string]interface{})["key"]), DeepEquals, []string{"b", "a"})
+	c.Assert(keyNames(indexes[1].(map[string]interface{})["key"]), DeepEquals, []string{"y", "x"})
+
+	aggregate := CanonicalizeOp(ops[2]).Content
+	c.Assert(keyNames(aggregate["hint"]), DeepEquals, []string{"c", "b"})
+	pipeline := aggregate["pipeline"].([]interface{})
+	c.Assert(keyNames(pipeline[0]), DeepEquals, []string{"$match"})
+	c.Assert(keyNames(pipeline[1].(bson.D)[0].Value), DeepEquals, []string{"n", "_id"})
+
+	c.Assert(CanonicalizeOp(ops[3]), IsNil)
+	c.Assert(CommandName(ops[3]), Equals, "renameCollection")
+}
+
+func (s *TestFileByLineOpsReaderSuite) TestKeyOrder(c *C) {
+	logger, _ = NewLogger("", "")
+
+	testJsonString :=
+		`{"op": "query", "ns": "db.coll", "query": {"$query": {"s": "a \"quoted\" {string}", "n": {"$numberLong": "5"}}, "$orderby": {"z": 1, "a": -1, "m": 1}, "$hint": {"z": 1, "a": -1, "m": 1}}, "ts": {"$date": 1396456709421}}
+		 {"op": "command", "ns": "db.$cmd", "command": {"createIndexes": "coll", "indexes": [{"key": {"b": 1, "a": -1}, "name": "b_1_a_-1"}, {"name": "y_1_x_1", "key": {"y": 1, "x": 1}}]}, "ts": {"$date": 1396456709422}}
+		 {"op": "command", "ns": "db.$cmd", "command": {"aggregate": "coll", "pipeline": [{"$match": {"a": 1}}, {"$sort": {"n": -1, "_id": 1}}], "hint": {"c": 1, "b": 1}, "cursor": {}}, "ts": {"$date": 1396456709423}}
+		 {"op": "command", "ns": "admin.$cmd", "command": {"renameCollection": "db.a", "to": "db.b", "dropTarget": false}, "ts": {"$date": 1396456709424}}`
+	err, loader := NewByLineOpsReader(bytes.NewReader([]byte(testJsonString)), logger, "")
+	c.Assert(err, Equals, nil)
+
+	ops := []*Op{}
+	for op := loader.Next(); op != nil; op = loader.Next() {
+		c.Assert(op.TextContent, Equals, "")
+		ops = append(ops, op)
+	}
+
+	// Record the same ops as BSON before CanonicalizeOp rewrites them
+	var buf bytes.Buffer
+	for _, op := range ops {
+		raw := bson.D{
+			{Name: "op", Value: string(op.Type)},
+			{Name: "ns", Value: op.Database + ".$cmd"},
+			{Name: "ts", Value: op.Timestamp},
+		}
+		if op.Type == Query {
+			raw[1].Value = op.Database + "." + op.Collection
+			q := op.Content["query"].(map[string]interface{})
+			raw = append(raw, bson.DocElem{Name: "query", Value: bson.D{
+				{Name: "$query", Value: q["$query"]},
+				{Name: "$orderby", Value: q["$orderby"]},
+				{Name: "$hint", Value: q["$hint"]},
+			}})
+		} else {
+			raw = append(raw, bson.DocElem{Name: "command", Value: op.Content["command"]})
+		}
+		doc, err := bson.Marshal(raw)
+		c.Assert(err, IsNil)
+		buf.Write(doc)
+	}
+	CheckKeyOrder(c, ops)
+
+	// The BSON reader keeps the same key order
+	err, bsonLoader := NewBSONOpsReader(&buf, logger, "")
+	c.Assert(err, Equals, nil)
+	ops = []*Op{}
+	for op := bsonLoader.Next(); op != nil; op = bsonLoader.Next() {
+		ops = append(ops, op)
+	}
+	c.Assert(bsonLoader.Err(), Equals, io.EOF)
+	CheckKeyOrder(c, ops)
+
+	// Values written in the shell's syntax are skipped over
+	order := scanKeyOrder(`{"b": NumberLong("1"), "t": Timestamp(1, 2), 'c': {"x, y": [1, {"z": "}"}]}}`)
+	c.Assert(order.keys, DeepEquals, []string{"b", "t", "c"})
+	c.Assert(order.items["c"].keys, DeepEquals, []string{"x, y"})
+	c.Assert(order.items["c"].items["x, y"].elems[1].keys, DeepEquals, []string{"z"})
+
+	// Unquoted keys end wherever JSON allows, and keys without a value are
+	// kept without swallowing what follows
+	order = scanKeyOrder("{a:1,b\t: 2, c\n:{d\r\n:[]}, e}")
+	c.Assert(order.keys, DeepEquals, []string{"a", "b", "c", "e"})
+	c.Assert(order.items["c"].keys, DeepEquals, []string{"d"})
+	order = scanKeyOrder("{x: {y}, z: 1}")
+	c.Assert(order.keys, DeepEquals, []string{"x", "z"})
+	c.Assert(order.items["x"].keys, DeepEquals, []string{"y"})
+
+	// The original text is only kept on demand
+	err, loader = NewByLineOpsReader(bytes.NewReader([]byte(testJsonString)), logger, "")
+	c.Assert(err, Equals, nil)
+	loader.KeepTextContent(true)
+	op := loader.Next()
+	c.Assert(strings.Contains(op.TextContent, `"$orderby"`), Equals, true)
+}
+
 func CheckTime(c *C, pythonTime float64, goTime time.Time) {
 	c.Assert(goTime.Unix(), Equals, int64(pythonTime)/1e3)
 	c.Assert(goTime.UnixNano(), Equals, int64(pythonTime)*1e6)
@@ -0,0 +1,108 @@
+package flashback
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// RetryPolicy decides whether a failed op is tried again, and how long to
+// wait before doing so.
+type RetryPolicy interface {
+	// Tell whether to retry after the given failed attempt (1 for the
+	// first one), and the delay before the retry.
+	Retry(attempt int, err error) (bool, time.Duration)
+}
+
+// BackoffRetryPolicy retries the errors of the given categories, up to
+// MaxAttempts attempts in total, with an exponential backoff: the delay starts
+// at InitialBackoff and doubles after each attempt, up to MaxBackoff. Jitter,
+// between 0 and 1, is the fraction of each delay that is randomized, so that
+// workers don't retry all at once, e.g. after a failover.
+type BackoffRetryPolicy struct {
+	MaxAttempts     int
+	InitialBackoff  time.Duration
+	MaxBackoff      time.Duration
+	Jitter          float64
+	RetryableErrors map[ErrorCategory]bool
+}
+
+// NewDefaultRetryPolicy retries network errors once, right away.
+func NewDefaultRetryPolicy() *BackoffRetryPolicy {
+	return &BackoffRetryPolicy{
+		MaxAttempts:     2,
+		RetryableErrors: map[ErrorCategory]bool{NetworkError: true},
+	}
+}
+
+func (p *BackoffRetryPolicy) Retry(attempt int, err error) (bool, time.Duration) {
+	if attempt >= p.MaxAttempts {
+		return false, 0
+	}
+	if category, _ := ClassifyError(err); !p.RetryableErrors[category] {
+		return false, 0
+	}
+
+	backoff := p.InitialBackoff
+	for i := 1; i < attempt && (p.MaxBackoff <= 0 || backoff < p.MaxBackoff); i++ {
+		backoff *= 2
+	}
+	if p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+		backoff = p.MaxBackoff
+	}
+	if p.Jitter > 0 {
+		backoff -= time.Duration(float64(backoff) * p.Jitter * rand.Float64())
+	}
+	return true, backoff
+}
+
+// ParseErrorCategories parses a comma separated list of error categories,
+// e.g. "network,not_primary".
+func ParseErrorCategories(text string) (map[ErrorCategory]bool, error) {
+	categories := make(map[ErrorCategory]bool)
+	if text == "" {
+		return categories, nil
+	}
+	for _, name := range strings.Split(text, ",") {
+		category := ErrorCategory(strings.TrimSpace(name))
+		known := false
+		for _, c := range AllErrorCategories {
+			if c == category {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown error category: %s", category)
+		}
+		categories[category] = true
+	}
+	return categories, nil
+}
+
+// Run block, and retry it as long as the policy says so and the op's deadline
+// allows. Returns the number of retries and the error of the last attempt.
+func retry(ctx context.Context, policy RetryPolicy, block func() error, logger *Logger) (int, error) {
+	for attempt := 1; ; attempt++ {
+		err := block()
+		if err == nil {
+			return attempt - 1, nil
+		}
+		ok, backoff := policy.Retry(attempt, err)
+		if !ok || ctx.Err() != nil {
+			return attempt - 1, err
+		}
+		logger.Error(fmt.Sprintf("retrying mongo query in %v after error: ", backoff), err)
+		if backoff > 0 {
+			timer := time.NewTimer(backoff)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return attempt - 1, err
+			}
+		}
+	}
+}
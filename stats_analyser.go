@@ -2,20 +2,71 @@ package flashback
 
 import (
 	"github.com/bmizerany/perks/quantile"
+	"sort"
 	"sync"
 	"time"
 )
 
 type OpStat struct {
-	OpType  OpType
-	Latency time.Duration
+	OpType OpType
+
+	// Latency is the service time of the op, from when it was picked up by
+	// a worker. ResponseTime is measured from when it was meant to be sent
+	// instead, so that it includes the time the op waited for a worker, see
+	// Op.IntendedTime. It is the same as Latency, or 0, for ops without a
+	// schedule.
+	Latency      time.Duration
+	ResponseTime time.Duration
+
 	OpError bool
+
+	// Whether a transaction ended without committing, either because it was
+	// recorded that way or because it failed
+	Aborted bool
+
+	// Whether the op timed out, in which case OpError isn't set
+	Timeout bool
+
+	// The category, server error code and message of the error the op
+	// failed with, if any, see ClassifyError
+	ErrorCategory ErrorCategory
+	ErrorCode     int
+	ErrorMessage  string
+
+	// How many times the op was retried, see RetryPolicy
+	Retries int
+}
+
+// ErrorCount counts the ops that failed with a given error
+type ErrorCount struct {
+	Category ErrorCategory
+	Code     int
+	Message  string
+	Count    int64
+}
+
+type errorKey struct {
+	category ErrorCategory
+	code     int
+	message  string
 }
 
 var (
 	latencyPercentiles = []float64{0.5, 0.7, 0.9, 0.95, 0.99}
 )
 
+const (
+	// Error messages may contain values, such as the duplicate key, so they
+	// are truncated and only so many different messages are counted. The
+	// others are counted together.
+	maxErrorMessageLength = 200
+	maxErrorMessages      = 1000
+	otherErrorMessages    = "(other messages)"
+
+	// How many of the most frequent error messages are reported
+	topErrorsSize = 5
+)
+
 // Percentiles
 const (
 	P50 = iota
@@ -32,19 +83,50 @@ type StatsAnalyzer struct {
 	stream      map[OpType]*quantile.Stream
 	maxLatency  map[OpType]float64
 	opsExecuted int64
+
+	responseStream  map[OpType]*quantile.Stream
+	maxResponseTime map[OpType]float64
+
 	opsErrors   int64
+	opsTimeouts int64
+	retries     int64
+	exhausted   int64
 	counts      map[OpType]int64
+	aborted     int64
+	errorCounts map[OpType]map[ErrorCategory]int64
+	errors      map[errorKey]int64
 
 	intervalStartTime   time.Time
 	intervalStream      map[OpType]*quantile.Stream
 	intervalMaxLatency  map[OpType]float64
 	intervalOpsExecuted int64
+
+	intervalResponseStream  map[OpType]*quantile.Stream
+	intervalMaxResponseTime map[OpType]float64
+
 	intervalOpsErrors   int64
+	intervalOpsTimeouts int64
+	intervalRetries     int64
+	intervalExhausted   int64
 	intervalCounts      map[OpType]int64
+	intervalAborted     int64
+	intervalErrorCounts map[OpType]map[ErrorCategory]int64
+	intervalErrors      map[errorKey]int64
+
+	// see SetTargetRate
+	targetRate func() float64
 
 	mutex *sync.Mutex
 }
 
+// SetTargetRate tags each interval with the rate ops are sent at when it
+// ends, as given by targetRate, e.g. DispatchStats.TargetRate.
+func (s *StatsAnalyzer) SetTargetRate(targetRate func() float64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.targetRate = targetRate
+}
+
 func (s *StatsAnalyzer) process(opStat OpStat) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
@@ -57,6 +139,26 @@ func (s *StatsAnalyzer) process(opStat OpStat) {
 		s.opsErrors++
 		s.intervalOpsErrors++
 	}
+	if opStat.Timeout {
+		s.opsTimeouts++
+		s.intervalOpsTimeouts++
+	}
+	if opStat.Retries > 0 {
+		s.retries += int64(opStat.Retries)
+		s.intervalRetries += int64(opStat.Retries)
+		if opStat.ErrorCategory != "" {
+			s.exhausted++
+			s.intervalExhausted++
+		}
+	}
+	if opStat.Aborted {
+		s.aborted++
+		s.intervalAborted++
+	}
+	if opStat.ErrorCategory != "" {
+		countError(s.errorCounts, s.errors, opStat)
+		countError(s.intervalErrorCounts, s.intervalErrors, opStat)
+	}
 
 	latencyMs := float64(opStat.Latency) / float64(time.Millisecond)
 	s.stream[opStat.OpType].Insert(latencyMs)
@@ -68,29 +170,103 @@ func (s *StatsAnalyzer) process(opStat OpStat) {
 	if s.intervalMaxLatency[opStat.OpType] < latencyMs {
 		s.intervalMaxLatency[opStat.OpType] = latencyMs
 	}
+
+	responseTimeMs := float64(opStat.ResponseTime) / float64(time.Millisecond)
+	if responseTimeMs < latencyMs {
+		responseTimeMs = latencyMs
+	}
+	s.responseStream[opStat.OpType].Insert(responseTimeMs)
+	s.intervalResponseStream[opStat.OpType].Insert(responseTimeMs)
+	if s.maxResponseTime[opStat.OpType] < responseTimeMs {
+		s.maxResponseTime[opStat.OpType] = responseTimeMs
+	}
+	if s.intervalMaxResponseTime[opStat.OpType] < responseTimeMs {
+		s.intervalMaxResponseTime[opStat.OpType] = responseTimeMs
+	}
+}
+
+func countError(counts map[OpType]map[ErrorCategory]int64, errors map[errorKey]int64, opStat OpStat) {
+	if counts[opStat.OpType] == nil {
+		counts[opStat.OpType] = make(map[ErrorCategory]int64)
+	}
+	counts[opStat.OpType][opStat.ErrorCategory]++
+
+	message := opStat.ErrorMessage
+	if len(message) > maxErrorMessageLength {
+		message = message[:maxErrorMessageLength]
+	}
+	key := errorKey{opStat.ErrorCategory, opStat.ErrorCode, message}
+	if _, ok := errors[key]; !ok && len(errors) >= maxErrorMessages {
+		key.message = otherErrorMessages
+	}
+	errors[key]++
+}
+
+// Get the most frequent errors, most frequent first
+func topErrors(errors map[errorKey]int64) []ErrorCount {
+	top := make([]ErrorCount, 0, len(errors))
+	for key, count := range errors {
+		top = append(top, ErrorCount{key.category, key.code, key.message, count})
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Count != top[j].Count {
+			return top[i].Count > top[j].Count
+		}
+		return top[i].Message < top[j].Message
+	})
+	if len(top) > topErrorsSize {
+		top = top[:topErrorsSize]
+	}
+	return top
+}
+
+// Copy the error counts of each op type
+func copyErrorCounts(counts map[OpType]map[ErrorCategory]int64) map[OpType]map[ErrorCategory]int64 {
+	copied := make(map[OpType]map[ErrorCategory]int64, len(counts))
+	for opType, categories := range counts {
+		copied[opType] = make(map[ErrorCategory]int64, len(categories))
+		for category, count := range categories {
+			copied[opType][category] = count
+		}
+	}
+	return copied
 }
 
 func NewStatsAnalyzer(statsChan chan OpStat) *StatsAnalyzer {
 	stream := make(map[OpType]*quantile.Stream)
 	intervalStream := make(map[OpType]*quantile.Stream)
+	responseStream := make(map[OpType]*quantile.Stream)
+	intervalResponseStream := make(map[OpType]*quantile.Stream)
 	for _, opType := range AllOpTypes {
 		stream[opType] = quantile.NewTargeted(0.5, 0.7, 0.9, 0.95, 0.99)
 		intervalStream[opType] = quantile.NewTargeted(0.5, 0.7, 0.9, 0.95, 0.99)
+		responseStream[opType] = quantile.NewTargeted(0.5, 0.7, 0.9, 0.95, 0.99)
+		intervalResponseStream[opType] = quantile.NewTargeted(0.5, 0.7, 0.9, 0.95, 0.99)
 	}
 	statsAnalyzer := &StatsAnalyzer{
 		statsChan:           statsChan,
 		startTime:           time.Now(),
 		stream:              stream,
 		maxLatency:          make(map[OpType]float64),
+		responseStream:      responseStream,
+		maxResponseTime:     make(map[OpType]float64),
 		opsExecuted:         0,
 		opsErrors:           0,
 		counts:              make(map[OpType]int64),
+		errorCounts:         make(map[OpType]map[ErrorCategory]int64),
+		errors:              make(map[errorKey]int64),
 		intervalStartTime:   time.Now(),
 		intervalStream:      intervalStream,
 		intervalMaxLatency:  make(map[OpType]float64),
 		intervalOpsExecuted: 0,
+
+		intervalResponseStream:  intervalResponseStream,
+		intervalMaxResponseTime: make(map[OpType]float64),
+
 		intervalOpsErrors:   0,
 		intervalCounts:      make(map[OpType]int64),
+		intervalErrorCounts: make(map[OpType]map[ErrorCategory]int64),
+		intervalErrors:      make(map[errorKey]int64),
 		mutex:               &sync.Mutex{},
 	}
 
@@ -113,6 +289,8 @@ type ExecutionStatus struct {
 	IntervalOpsExecuted int64
 	OpsErrors           int64
 	IntervalOpsErrors   int64
+	OpsTimeouts         int64
+	IntervalOpsTimeouts int64
 	OpsPerSec           float64
 	IntervalOpsPerSec   float64
 	IntervalDuration    time.Duration
@@ -124,6 +302,36 @@ type ExecutionStatus struct {
 	IntervalCounts      map[OpType]int64
 	TypeOpsSec          map[OpType]float64
 	IntervalTypeOpsSec  map[OpType]float64
+
+	// Retries, and the ops that failed even though they were retried
+	Retries                  int64
+	IntervalRetries          int64
+	RetriesExhausted         int64
+	IntervalRetriesExhausted int64
+
+	// Transactions that didn't commit, and their share of all transactions
+	TransactionsAborted          int64
+	IntervalTransactionsAborted  int64
+	TransactionAbortRate         float64
+	IntervalTransactionAbortRate float64
+
+	// Errors, timeouts included, by op type and category, and the most
+	// frequent error messages
+	ErrorCounts         map[OpType]map[ErrorCategory]int64
+	IntervalErrorCounts map[OpType]map[ErrorCategory]int64
+	TopErrors           []ErrorCount
+	IntervalTopErrors   []ErrorCount
+
+	// Percentiles and maximum of the response times, by op type. Latencies
+	// are service times, see OpStat.
+	ResponseTimes           map[OpType][]float64
+	IntervalResponseTimes   map[OpType][]float64
+	MaxResponseTime         map[OpType]float64
+	IntervalMaxResponseTime map[OpType]float64
+
+	// The rate ops were sent at when the interval ended, in ops/sec, or 0
+	// if it isn't known, see SetTargetRate
+	TargetOpsPerSec float64
 }
 
 func (s *StatsAnalyzer) GetStatus() *ExecutionStatus {
@@ -150,6 +358,10 @@ func (s *StatsAnalyzer) GetStatus() *ExecutionStatus {
 	intervalTypeOpsSec := make(map[OpType]float64)
 	maxLatency := make(map[OpType]float64)
 	intervalMaxLatency := make(map[OpType]float64)
+	responseTimes := make(map[OpType][]float64)
+	intervalResponseTimes := make(map[OpType][]float64)
+	maxResponseTime := make(map[OpType]float64)
+	intervalMaxResponseTime := make(map[OpType]float64)
 
 	for _, opType := range AllOpTypes {
 		maxLatency[opType] = s.maxLatency[opType]
@@ -158,7 +370,12 @@ func (s *StatsAnalyzer) GetStatus() *ExecutionStatus {
 			latencies[opType] = append(latencies[opType], s.stream[opType].Query(percentile))
 			intervalLatencies[opType] = append(intervalLatencies[opType],
 				s.intervalStream[opType].Query(percentile))
+			responseTimes[opType] = append(responseTimes[opType], s.responseStream[opType].Query(percentile))
+			intervalResponseTimes[opType] = append(intervalResponseTimes[opType],
+				s.intervalResponseStream[opType].Query(percentile))
 		}
+		maxResponseTime[opType] = s.maxResponseTime[opType]
+		intervalMaxResponseTime[opType] = s.intervalMaxResponseTime[opType]
 		counts[opType] = s.counts[opType]
 		intervalCounts[opType] = s.intervalCounts[opType]
 
@@ -171,6 +388,8 @@ func (s *StatsAnalyzer) GetStatus() *ExecutionStatus {
 		IntervalOpsExecuted: intervalOpsExecuted,
 		OpsErrors:           opsErrors,
 		IntervalOpsErrors:   intervalOpsErrors,
+		OpsTimeouts:         s.opsTimeouts,
+		IntervalOpsTimeouts: s.intervalOpsTimeouts,
 		OpsPerSec:           opsPerSec,
 		IntervalOpsPerSec:   intervalOpsPerSec,
 		IntervalDuration:    intervalDuration,
@@ -182,6 +401,33 @@ func (s *StatsAnalyzer) GetStatus() *ExecutionStatus {
 		IntervalCounts:      intervalCounts,
 		TypeOpsSec:          typeOpsSec,
 		IntervalTypeOpsSec:  intervalTypeOpsSec,
+
+		Retries:                  s.retries,
+		IntervalRetries:          s.intervalRetries,
+		RetriesExhausted:         s.exhausted,
+		IntervalRetriesExhausted: s.intervalExhausted,
+
+		TransactionsAborted:         s.aborted,
+		IntervalTransactionsAborted: s.intervalAborted,
+
+		ErrorCounts:         copyErrorCounts(s.errorCounts),
+		IntervalErrorCounts: copyErrorCounts(s.intervalErrorCounts),
+		TopErrors:           topErrors(s.errors),
+		IntervalTopErrors:   topErrors(s.intervalErrors),
+
+		ResponseTimes:           responseTimes,
+		IntervalResponseTimes:   intervalResponseTimes,
+		MaxResponseTime:         maxResponseTime,
+		IntervalMaxResponseTime: intervalMaxResponseTime,
+	}
+	if s.targetRate != nil {
+		status.TargetOpsPerSec = s.targetRate()
+	}
+	if s.counts[Transaction] > 0 {
+		status.TransactionAbortRate = float64(s.aborted) / float64(s.counts[Transaction])
+	}
+	if s.intervalCounts[Transaction] > 0 {
+		status.IntervalTransactionAbortRate = float64(s.intervalAborted) / float64(s.intervalCounts[Transaction])
 	}
 
 	// reset interval
@@ -190,9 +436,49 @@ func (s *StatsAnalyzer) GetStatus() *ExecutionStatus {
 		s.intervalStream[opType].Reset()
 		s.intervalCounts[opType] = 0
 		s.intervalMaxLatency[opType] = 0
+		s.intervalResponseStream[opType].Reset()
+		s.intervalMaxResponseTime[opType] = 0
 	}
 	s.intervalOpsExecuted = 0
 	s.intervalOpsErrors = 0
+	s.intervalOpsTimeouts = 0
+	s.intervalRetries = 0
+	s.intervalExhausted = 0
+	s.intervalAborted = 0
+	s.intervalErrorCounts = make(map[OpType]map[ErrorCategory]int64)
+	s.intervalErrors = make(map[errorKey]int64)
 
 	return &status
 }
+
+// OpCounter counts ops by name (e.g. the name of a command). It is safe to use
+// from multiple goroutines.
+type OpCounter struct {
+	counts map[string]int64
+	mutex  *sync.Mutex
+}
+
+func NewOpCounter() *OpCounter {
+	return &OpCounter{
+		counts: make(map[string]int64),
+		mutex:  &sync.Mutex{},
+	}
+}
+
+func (c *OpCounter) Add(name string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.counts[name]++
+}
+
+// Counts returns a snapshot of the counts.
+func (c *OpCounter) Counts() map[string]int64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	counts := make(map[string]int64, len(c.counts))
+	for name, count := range c.counts {
+		counts[name] = count
+	}
+	return counts
+}
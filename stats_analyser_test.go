@@ -1,7 +1,9 @@
 package flashback
 
 import (
+	"fmt"
 	"math"
+	"strings"
 	"testing"
 	"time"
 
@@ -27,7 +29,7 @@ func (s *TestStatsAnalyzerSuite) TestBasics(c *C) {
 
 	for i := 0; i < 10; i += 1 {
 		for _, opType := range AllOpTypes {
-			statsChan <- OpStat{opType, time.Duration(i) * time.Millisecond, false}
+			statsChan <- OpStat{OpType: opType, Latency: time.Duration(i) * time.Millisecond}
 		}
 	}
 	time.Sleep(100 * time.Millisecond)
@@ -36,8 +38,8 @@ func (s *TestStatsAnalyzerSuite) TestBasics(c *C) {
 	c.Assert(status.IntervalOpsExecuted, Equals, int64(10*len(AllOpTypes)))
 	c.Assert(status.OpsErrors, Equals, int64(0))
 	c.Assert(status.IntervalOpsErrors, Equals, int64(0))
-	floatEquals(status.OpsPerSec, 600.0, c)
-	floatEquals(status.IntervalOpsPerSec, 600.0, c)
+	floatEquals(status.OpsPerSec, float64(10*len(AllOpTypes))/0.1, c)
+	floatEquals(status.IntervalOpsPerSec, float64(10*len(AllOpTypes))/0.1, c)
 
 	for _, opType := range AllOpTypes {
 		c.Assert(status.Latencies[opType][P50], Equals, float64(4))
@@ -61,22 +63,25 @@ func (s *TestStatsAnalyzerSuite) TestBasics(c *C) {
 	// second interval
 	for i := 0; i < 10; i += 1 {
 		for _, opType := range AllOpTypes {
-			statsChan <- OpStat{opType, time.Duration(i) * time.Millisecond, false}
+			statsChan <- OpStat{OpType: opType, Latency: time.Duration(i) * time.Millisecond}
 		}
 	}
-	statsChan <- OpStat{Insert, 0, true}
+	statsChan <- OpStat{OpType: Insert, Latency: 0, OpError: true}
+	statsChan <- OpStat{OpType: Query, Latency: 0, Timeout: true}
 	time.Sleep(200 * time.Millisecond)
 
 	status = analyser.GetStatus()
-	c.Assert(status.OpsExecuted, Equals, int64(20*len(AllOpTypes))+1)
-	c.Assert(status.IntervalOpsExecuted, Equals, int64(10*len(AllOpTypes))+1)
+	c.Assert(status.OpsExecuted, Equals, int64(20*len(AllOpTypes))+2)
+	c.Assert(status.IntervalOpsExecuted, Equals, int64(10*len(AllOpTypes))+2)
 	c.Assert(status.OpsErrors, Equals, int64(1))
 	c.Assert(status.IntervalOpsErrors, Equals, int64(1))
-	floatEquals(status.OpsPerSec, 400.0, c)
-	floatEquals(status.IntervalOpsPerSec, 300.0, c)
+	c.Assert(status.OpsTimeouts, Equals, int64(1))
+	c.Assert(status.IntervalOpsTimeouts, Equals, int64(1))
+	floatEquals(status.OpsPerSec, float64(20*len(AllOpTypes)+2)/0.3, c)
+	floatEquals(status.IntervalOpsPerSec, float64(10*len(AllOpTypes)+2)/0.2, c)
 
 	for _, opType := range AllOpTypes {
-		if opType == Insert {
+		if opType == Insert || opType == Query {
 			c.Assert(status.Counts[opType], Equals, int64(21))
 			c.Assert(status.IntervalCounts[opType], Equals, int64(11))
 		} else {
@@ -95,7 +100,7 @@ func (s *TestStatsAnalyzerSuite) TestLatencies(c *C) {
 	start := 1000
 	for _, opType := range AllOpTypes {
 		for i := 100; i >= 0; i-- {
-			statsChan <- OpStat{opType, time.Duration(start+i) * time.Millisecond, false}
+			statsChan <- OpStat{OpType: opType, Latency: time.Duration(start+i) * time.Millisecond}
 		}
 		start += 2000
 	}
@@ -119,7 +124,7 @@ func (s *TestStatsAnalyzerSuite) TestLatencies(c *C) {
 	start = 2000
 	for _, opType := range AllOpTypes {
 		for i := 100; i >= 0; i-- {
-			statsChan <- OpStat{opType, time.Duration(start+i) * time.Millisecond, false}
+			statsChan <- OpStat{OpType: opType, Latency: time.Duration(start+i) * time.Millisecond}
 		}
 		start += 2000
 	}
@@ -138,3 +143,154 @@ func (s *TestStatsAnalyzerSuite) TestLatencies(c *C) {
 		start += 2000
 	}
 }
+
+func (s *TestStatsAnalyzerSuite) TestOpCounter(c *C) {
+	counter := NewOpCounter()
+	done := make(chan bool)
+	for i := 0; i < 10; i++ {
+		go func() {
+			counter.Add("ping")
+			done <- true
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		<-done
+	}
+	counter.Add("dbStats")
+
+	c.Assert(counter.Counts(), DeepEquals, map[string]int64{"ping": 10, "dbStats": 1})
+}
+
+func (s *TestStatsAnalyzerSuite) TestTransactions(c *C) {
+	statsChan := make(chan OpStat)
+	analyser := NewStatsAnalyzer(statsChan)
+
+	for i := 0; i < 8; i++ {
+		statsChan <- OpStat{OpType: Transaction, Latency: time.Duration(i) * time.Millisecond, Aborted: i%4 == 0}
+	}
+	time.Sleep(10 * time.Millisecond)
+	status := analyser.GetStatus()
+	c.Assert(status.Counts[Transaction], Equals, int64(8))
+	c.Assert(status.TransactionsAborted, Equals, int64(2))
+	c.Assert(status.TransactionAbortRate, Equals, 0.25)
+	c.Assert(status.IntervalTransactionAbortRate, Equals, 0.25)
+
+	// a failed transaction is aborted too
+	statsChan <- OpStat{OpType: Transaction, Latency: time.Millisecond, OpError: true, Aborted: true}
+	statsChan <- OpStat{OpType: Insert, Latency: time.Millisecond}
+	time.Sleep(10 * time.Millisecond)
+	status = analyser.GetStatus()
+	c.Assert(status.TransactionsAborted, Equals, int64(3))
+	c.Assert(status.IntervalTransactionsAborted, Equals, int64(1))
+	c.Assert(status.TransactionAbortRate, Equals, 3.0/9)
+	c.Assert(status.IntervalTransactionAbortRate, Equals, 1.0)
+
+	// no transactions in the interval
+	status = analyser.GetStatus()
+	c.Assert(status.IntervalTransactionAbortRate, Equals, 0.0)
+}
+
+func (s *TestStatsAnalyzerSuite) TestErrors(c *C) {
+	statsChan := make(chan OpStat)
+	analyser := NewStatsAnalyzer(statsChan)
+
+	duplicateKey := OpStat{OpType: Insert, OpError: true, ErrorCategory: DuplicateKeyError, ErrorCode: 11000,
+		ErrorMessage: "E11000 duplicate key error"}
+	for i := 0; i < 3; i++ {
+		statsChan <- duplicateKey
+	}
+	statsChan <- OpStat{OpType: Query, Timeout: true, ErrorCategory: TimeoutError, ErrorCode: 50,
+		ErrorMessage: "operation exceeded time limit"}
+	statsChan <- OpStat{OpType: Insert, OpError: true, ErrorCategory: NetworkError,
+		ErrorMessage: strings.Repeat("x", 500)}
+	time.Sleep(10 * time.Millisecond)
+
+	status := analyser.GetStatus()
+	c.Assert(status.ErrorCounts[Insert], DeepEquals, map[ErrorCategory]int64{DuplicateKeyError: 3, NetworkError: 1})
+	c.Assert(status.ErrorCounts[Query], DeepEquals, map[ErrorCategory]int64{TimeoutError: 1})
+	c.Assert(status.IntervalErrorCounts, DeepEquals, status.ErrorCounts)
+	c.Assert(len(status.TopErrors), Equals, 3)
+	c.Assert(status.TopErrors[0], DeepEquals, ErrorCount{DuplicateKeyError, 11000, "E11000 duplicate key error", 3})
+	c.Assert(len(status.TopErrors[2].Message), Equals, maxErrorMessageLength)
+	c.Assert(status.IntervalTopErrors, DeepEquals, status.TopErrors)
+
+	// the interval counts start over, and messages past the limit are
+	// counted together
+	for i := 0; i < maxErrorMessages+10; i++ {
+		statsChan <- OpStat{OpType: Update, OpError: true, ErrorCategory: OtherServerError, ErrorCode: 2,
+			ErrorMessage: fmt.Sprintf("bad value %d", i)}
+	}
+	time.Sleep(10 * time.Millisecond)
+	status = analyser.GetStatus()
+	c.Assert(status.ErrorCounts[Insert][DuplicateKeyError], Equals, int64(3))
+	c.Assert(status.IntervalErrorCounts[Insert], IsNil)
+	c.Assert(status.IntervalErrorCounts[Update][OtherServerError], Equals, int64(maxErrorMessages+10))
+	c.Assert(status.TopErrors[0].Message, Equals, otherErrorMessages)
+	c.Assert(status.TopErrors[0].Count, Equals, int64(13))
+	c.Assert(status.IntervalTopErrors[0].Message, Equals, otherErrorMessages)
+	c.Assert(status.IntervalTopErrors[0].Count, Equals, int64(10))
+	c.Assert(len(status.IntervalTopErrors), Equals, topErrorsSize)
+}
+
+func (s *TestStatsAnalyzerSuite) TestRetries(c *C) {
+	statsChan := make(chan OpStat)
+	analyser := NewStatsAnalyzer(statsChan)
+
+	statsChan <- OpStat{OpType: Insert, Retries: 2}
+	statsChan <- OpStat{OpType: Insert, Retries: 1, OpError: true, ErrorCategory: NetworkError}
+	statsChan <- OpStat{OpType: Insert, OpError: true, ErrorCategory: NetworkError}
+	time.Sleep(10 * time.Millisecond)
+	status := analyser.GetStatus()
+	c.Assert(status.Retries, Equals, int64(3))
+	c.Assert(status.IntervalRetries, Equals, int64(3))
+	c.Assert(status.RetriesExhausted, Equals, int64(1))
+	c.Assert(status.IntervalRetriesExhausted, Equals, int64(1))
+	c.Assert(status.OpsErrors, Equals, int64(2))
+
+	statsChan <- OpStat{OpType: Query, Retries: 1}
+	time.Sleep(10 * time.Millisecond)
+	status = analyser.GetStatus()
+	c.Assert(status.Retries, Equals, int64(4))
+	c.Assert(status.IntervalRetries, Equals, int64(1))
+	c.Assert(status.RetriesExhausted, Equals, int64(1))
+	c.Assert(status.IntervalRetriesExhausted, Equals, int64(0))
+}
+
+func (s *TestStatsAnalyzerSuite) TestTargetRate(c *C) {
+	statsChan := make(chan OpStat)
+	analyser := NewStatsAnalyzer(statsChan)
+	c.Assert(analyser.GetStatus().TargetOpsPerSec, Equals, 0.0)
+
+	rate := 1000.0
+	analyser.SetTargetRate(func() float64 {
+		return rate
+	})
+	c.Assert(analyser.GetStatus().TargetOpsPerSec, Equals, 1000.0)
+	rate = 3000
+	c.Assert(analyser.GetStatus().TargetOpsPerSec, Equals, 3000.0)
+}
+
+func (s *TestStatsAnalyzerSuite) TestResponseTimes(c *C) {
+	statsChan := make(chan OpStat)
+	analyser := NewStatsAnalyzer(statsChan)
+
+	// ops that waited for a worker, and one without a schedule
+	for i := 0; i < 10; i++ {
+		statsChan <- OpStat{OpType: Query, Latency: time.Millisecond, ResponseTime: 100 * time.Millisecond}
+	}
+	statsChan <- OpStat{OpType: Insert, Latency: 2 * time.Millisecond}
+	time.Sleep(10 * time.Millisecond)
+
+	status := analyser.GetStatus()
+	c.Assert(status.Latencies[Query][P99], Equals, 1.0)
+	c.Assert(status.ResponseTimes[Query][P50], Equals, 100.0)
+	c.Assert(status.IntervalResponseTimes[Query][P99], Equals, 100.0)
+	c.Assert(status.MaxLatency[Query], Equals, 1.0)
+	c.Assert(status.MaxResponseTime[Query], Equals, 100.0)
+	c.Assert(status.ResponseTimes[Insert][P50], Equals, 2.0)
+	c.Assert(status.MaxResponseTime[Insert], Equals, 2.0)
+
+	status = analyser.GetStatus()
+	c.Assert(status.MaxResponseTime[Query], Equals, 100.0)
+	c.Assert(status.IntervalMaxResponseTime[Query], Equals, 0.0)
+}
@@ -0,0 +1,63 @@
+package flashback
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Timeouts bounds how long an op may run, on the server with maxTimeMS and on
+// the client with a deadline. The zero value keeps the maxTimeMS the ops were
+// recorded with, if any, and sets no deadline.
+type Timeouts struct {
+	// maxTimeMS of the ops that support it, instead of the recorded one.
+	// MaxTimeMsByType takes precedence for the op types it lists.
+	MaxTimeMs       int
+	MaxTimeMsByType map[OpType]int
+
+	// Deadline of each op on the client side, retries included. A
+	// transaction is bounded as a whole.
+	Deadline time.Duration
+}
+
+// The maxTimeMS an op of the given type is replayed with, or 0 to keep the
+// recorded one.
+func (t *Timeouts) maxTimeMs(opType OpType) int {
+	if maxTimeMs, ok := t.MaxTimeMsByType[opType]; ok {
+		return maxTimeMs
+	}
+	return t.MaxTimeMs
+}
+
+// ParseMaxTimeMsByType parses maxTimeMS overrides by op type, such as
+// "query:1000,command.aggregate:5000".
+func ParseMaxTimeMsByType(text string) (map[OpType]int, error) {
+	byType := make(map[OpType]int)
+	if text == "" {
+		return byType, nil
+	}
+	for _, override := range strings.Split(text, ",") {
+		parts := strings.SplitN(override, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid maxTimeMS override: %s", override)
+		}
+		opType := OpType(strings.TrimSpace(parts[0]))
+		known := false
+		for _, t := range AllOpTypes {
+			if t == opType {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown op type: %s", opType)
+		}
+		maxTimeMs, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || maxTimeMs < 0 {
+			return nil, fmt.Errorf("invalid maxTimeMS for %s: %s", opType, parts[1])
+		}
+		byType[opType] = maxTimeMs
+	}
+	return byType, nil
+}
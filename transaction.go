@@ -0,0 +1,205 @@
+package flashback
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Get the logical session and transaction number of an op recorded as part
+// of a multi-document transaction. The session is empty for other ops,
+// including retryable writes, which also carry a session and a transaction
+// number but run on their own.
+func transactionOf(rawDoc Document, command map[string]interface{}) (string, int64) {
+	if command["autocommit"] != false && rawDoc["autocommit"] != false {
+		return "", 0
+	}
+	lsid, ok := asMap(command["lsid"])
+	if !ok {
+		if lsid, ok = asMap(rawDoc["lsid"]); !ok {
+			return "", 0
+		}
+	}
+	txnNumber, err := safeGetInt(command["txnNumber"])
+	if err != nil {
+		if txnNumber, err = safeGetInt(rawDoc["txnNumber"]); err != nil {
+			return "", 0
+		}
+	}
+	return fmt.Sprint(lsid["id"]), int64(txnNumber)
+}
+
+// Tell whether a command ends a transaction, and whether it commits it.
+func transactionEnd(command map[string]interface{}) (commit bool, ends bool) {
+	if _, ok := command["commitTransaction"]; ok {
+		return true, true
+	}
+	if _, ok := command["abortTransaction"]; ok {
+		return false, true
+	}
+	return false, false
+}
+
+// TransactionOpsReader groups the ops recorded in the same multi-document
+// transaction into a single Transaction op, so that a worker replays them
+// together in a session. The Transaction op is returned once the recorded
+// transaction ends, and commits or aborts the way it was recorded. Other ops
+// are returned as they are read.
+//
+// The profiler doesn't always record commitTransaction, so transactions that
+// never end in the source are committed: when their session starts another
+// transaction, when a CyclicOpsReader starts over, or at the end of the
+// source. NeverEnded tells how many there were.
+//
+// Transaction ops keep the timestamp of their first op, and their
+// EndTimestamp is the timestamp of the op that ended them, e.g. the commit,
+// or of the last op read before they were committed.
+type TransactionOpsReader struct {
+	reader OpsReader
+	logger *Logger
+
+	// the last op read from the source
+	last *Op
+
+	// the transactions in progress, by session, and the ops ready to be
+	// returned: the transactions that ended, and the ops read after them
+	open  map[string]*Op
+	ready []*Op
+
+	// the cycle of the last op read
+	cycle      int
+	neverEnded int
+}
+
+func NewTransactionOpsReader(reader OpsReader, logger *Logger) *TransactionOpsReader {
+	return &TransactionOpsReader{
+		reader: reader,
+		logger: logger,
+		open:   make(map[string]*Op),
+	}
+}
+
+func (r *TransactionOpsReader) Next() *Op {
+	for len(r.ready) == 0 {
+		op := r.reader.Next()
+		if op == nil {
+			r.commitOpen()
+			if len(r.ready) == 0 {
+				return nil
+			}
+			break
+		}
+		if op.Cycle != r.cycle {
+			// the source started over, so the transactions in progress
+			// won't see their end
+			r.commitOpen()
+			r.cycle = op.Cycle
+		}
+		r.last = op
+		if op.Session == "" {
+			if len(r.ready) == 0 {
+				return op
+			}
+			r.ready = append(r.ready, op)
+		} else {
+			r.add(op)
+		}
+	}
+	op := r.ready[0]
+	r.ready[0] = nil
+	r.ready = r.ready[1:]
+	return op
+}
+
+func (r *TransactionOpsReader) add(op *Op) {
+	txn := r.open[op.Session]
+	if txn != nil && txn.TxnNumber != op.TxnNumber {
+		// a session only runs one transaction at a time
+		r.neverEnded++
+		r.end(txn, true)
+		txn = nil
+	}
+
+	command, _ := asMap(op.Content["command"])
+	if commit, ends := transactionEnd(command); ends {
+		// transactions that are left without ops, e.g. by the op filters,
+		// have nothing to replay
+		if txn != nil {
+			if command["writeConcern"] != nil {
+				txn.Content["writeConcern"] = command["writeConcern"]
+			}
+			r.end(txn, commit)
+		}
+		return
+	}
+
+	if txn == nil {
+		txn = &Op{
+			Database:   op.Database,
+			Collection: op.Collection,
+			Type:       Transaction,
+			Timestamp:  op.Timestamp,
+			Position:   op.Position,
+			Cycle:      op.Cycle,
+			Content:    Document{},
+			Session:    op.Session,
+			TxnNumber:  op.TxnNumber,
+		}
+		r.open[op.Session] = txn
+	}
+	txn.Ops = append(txn.Ops, op)
+}
+
+func (r *TransactionOpsReader) end(txn *Op, commit bool) {
+	txn.Content["commit"] = commit
+	txn.EndTimestamp = r.last.Timestamp
+	delete(r.open, txn.Session)
+	r.ready = append(r.ready, txn)
+}
+
+// Commit the transactions still in progress, in the order they started.
+func (r *TransactionOpsReader) commitOpen() {
+	if len(r.open) == 0 {
+		return
+	}
+	open := make([]*Op, 0, len(r.open))
+	for _, txn := range r.open {
+		open = append(open, txn)
+	}
+	sort.Slice(open, func(i, j int) bool {
+		return open[i].Timestamp.Before(open[j].Timestamp)
+	})
+	r.neverEnded += len(open)
+	for _, txn := range open {
+		r.end(txn, true)
+	}
+}
+
+// NeverEnded returns how many transactions never ended in the source, and were
+// committed.
+func (r *TransactionOpsReader) NeverEnded() int {
+	return r.neverEnded
+}
+
+func (r *TransactionOpsReader) OpsRead() int {
+	return r.reader.OpsRead()
+}
+
+func (r *TransactionOpsReader) AllLoaded() bool {
+	return r.reader.AllLoaded() && len(r.open) == 0 && len(r.ready) == 0
+}
+
+func (r *TransactionOpsReader) SkipOps(numSkipOps int) error {
+	return r.reader.SkipOps(numSkipOps)
+}
+
+func (r *TransactionOpsReader) SetStartTime(startTime int64) (int64, error) {
+	return r.reader.SetStartTime(startTime)
+}
+
+func (r *TransactionOpsReader) Err() error {
+	return r.reader.Err()
+}
+
+func (r *TransactionOpsReader) Close() {
+	r.reader.Close()
+}
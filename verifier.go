@@ -0,0 +1,191 @@
+package flashback
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Results longer than that are truncated when mismatches are logged
+const maxLoggedResultLength = 1000
+
+// The op types whose results are verified, see comparableResult
+var verifiedOpTypes = map[OpType]bool{
+	Query:         true,
+	Aggregate:     true,
+	Count:         true,
+	Distinct:      true,
+	FindAndModify: true,
+	Insert:        true,
+	Update:        true,
+	Remove:        true,
+}
+
+// ResultVerifier compares the results of the ops replayed against a
+// challenger with the results of the same ops against the default node. It is
+// safe to use from multiple goroutines.
+//
+// Only the parts of the results that don't depend on the server are compared:
+// the documents returned by queries and aggregations (in order only if they
+// are sorted), counts, distinct values, the documents returned by
+// findAndModify, and the number of documents matched and modified by writes.
+// Other ops aren't verified.
+type ResultVerifier struct {
+	name       string
+	logger     *Logger
+	verified   map[OpType]int64
+	mismatches map[OpType]int64
+	mutex      *sync.Mutex
+}
+
+func NewResultVerifier(name string, logger *Logger) *ResultVerifier {
+	return &ResultVerifier{
+		name:       name,
+		logger:     logger,
+		verified:   make(map[OpType]int64),
+		mismatches: make(map[OpType]int64),
+		mutex:      &sync.Mutex{},
+	}
+}
+
+// Verify compares the outcome of an op against the challenger with its
+// outcome against the default node, and logs the op if they differ. Ops that
+// failed on both nodes are considered to match. Returns false on mismatch.
+func (v *ResultVerifier) Verify(op *Op, expectedResult interface{}, expectedErr error,
+	actualResult interface{}, actualErr error) bool {
+	if !verifiedOpTypes[op.Type] {
+		return true
+	}
+	expected, ok := outcome(op, expectedResult, expectedErr)
+	if !ok {
+		return true
+	}
+	actual, ok := outcome(op, actualResult, actualErr)
+	if !ok {
+		return true
+	}
+
+	v.mutex.Lock()
+	v.verified[op.Type]++
+	match := expected == actual
+	if !match {
+		v.mismatches[op.Type]++
+	}
+	v.mutex.Unlock()
+
+	if !match {
+		v.logger.Error(fmt.Sprintf("[%s] result mismatch - type:%s,database:%s,collection:%s\n\t%v\n"+
+			"\texpected: %s\n\tgot: %s", v.name, op.Type, op.Database, op.Collection, op.Content,
+			describe(expected, expectedErr), describe(actual, actualErr)))
+	}
+	return match
+}
+
+// Counts returns how many ops were verified, and how many of them didn't
+// match, by op type.
+func (v *ResultVerifier) Counts() (map[OpType]int64, map[OpType]int64) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	verified := make(map[OpType]int64, len(v.verified))
+	mismatches := make(map[OpType]int64, len(v.mismatches))
+	for opType, count := range v.verified {
+		verified[opType] = count
+	}
+	for opType, count := range v.mismatches {
+		mismatches[opType] = count
+	}
+	return verified, mismatches
+}
+
+func describe(outcome string, err error) string {
+	if err != nil {
+		return "error: " + err.Error()
+	}
+	if len(outcome) > maxLoggedResultLength {
+		return outcome[:maxLoggedResultLength] + "..."
+	}
+	return outcome
+}
+
+// Describe the outcome of an op in a way that can be compared across nodes,
+// or return false if the op can't be verified.
+func outcome(op *Op, result interface{}, err error) (string, bool) {
+	if err != nil {
+		return "error", true
+	}
+	value, ordered, ok := comparableResult(op, result)
+	if !ok {
+		return "", false
+	}
+	return canonical(value, ordered), true
+}
+
+// Get the part of the result of an op that is compared, and whether its order
+// matters if it's a list.
+func comparableResult(op *Op, result interface{}) (interface{}, bool, bool) {
+	switch op.Type {
+	case Query, Aggregate:
+		if docs, ok := result.(*[]Document); ok {
+			return *docs, isSorted(op), true
+		}
+	case Count:
+		if n, ok := result.(int); ok {
+			return n, false, true
+		}
+	case Distinct, FindAndModify:
+		if reply, ok := result.(*bson.M); ok {
+			if op.Type == Distinct {
+				return (*reply)["values"], false, true
+			}
+			return (*reply)["value"], false, true
+		}
+	case Insert, Update, Remove:
+		// the ids of upserted documents may be generated by the server
+		if w, ok := result.(*writeResult); ok {
+			return []int{w.N, w.NModified, len(w.Upserted)}, true, true
+		}
+	}
+	return nil, false, false
+}
+
+// Tell whether the documents returned by a query or an aggregation are sorted
+func isSorted(op *Op) bool {
+	if op.Type == Query {
+		q, _ := asMap(op.Content["query"])
+		return q["$orderby"] != nil
+	}
+	pipeline, _ := op.Content["pipeline"].([]interface{})
+	for _, stage := range pipeline {
+		if s, ok := asMap(stage); ok && s["$sort"] != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Get a canonical representation of a value. Maps are printed with their keys
+// sorted, and numbers the same way whatever their type, so that e.g. an int32
+// and an int64 compare equal. Unordered lists are sorted.
+func canonical(value interface{}, ordered bool) string {
+	var items []string
+	switch list := value.(type) {
+	case []Document:
+		for _, item := range list {
+			items = append(items, fmt.Sprint(map[string]interface{}(item)))
+		}
+	case []interface{}:
+		for _, item := range list {
+			items = append(items, fmt.Sprint(item))
+		}
+	default:
+		return fmt.Sprint(value)
+	}
+	if !ordered {
+		sort.Strings(items)
+	}
+	return "[" + strings.Join(items, " ") + "]"
+}